@@ -8,6 +8,7 @@ import (
 	"github.com/bgpfix/bgpfix/caps"
 	"github.com/bgpfix/bgpfix/msg"
 	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/knadh/koanf/providers/posflag"
 	"github.com/rs/zerolog"
 )
 
@@ -59,6 +60,7 @@ func (b *Bgpipe) AttachStages() error {
 		}
 
 		s := b.NewStage("stdout")
+		s.K.Load(posflag.Provider(s.Options.Flags, ".", s.K), nil) // defaults
 		s.K.Set("left", true)
 		s.K.Set("right", true)
 		if k.Bool("stdout-wait") {
@@ -77,6 +79,7 @@ func (b *Bgpipe) AttachStages() error {
 		}
 
 		s := b.NewStage("stdin")
+		s.K.Load(posflag.Provider(s.Options.Flags, ".", s.K), nil) // defaults
 		s.K.Set("left", true)
 		s.K.Set("right", true)
 		s.K.Set("inject", "first")
@@ -101,8 +104,11 @@ func (b *Bgpipe) AttachStages() error {
 		p.Caps.Use(caps.CAP_AS4) // use CAP_AS4 by default
 	}
 
+	// update peer ASNs on OPEN
+	p.Options.OnEvent(b.onOpen, pipe.EVENT_OPEN)
+
 	// log events?
-	if evs := b.parseEvents(k, "events", "START", "STOP", "READY", "PREPARE"); len(evs) > 0 {
+	if evs := b.ParseEvents(k, "events", "START", "STOP", "READY", "PREPARE"); len(evs) > 0 {
 		p.Options.AddHandler(b.LogEvent, &pipe.Handler{
 			Pre:   true,
 			Order: math.MinInt,
@@ -111,7 +117,7 @@ func (b *Bgpipe) AttachStages() error {
 	}
 
 	// kill events?
-	if evs := b.parseEvents(k, "kill", "STOP"); len(evs) > 0 {
+	if evs := b.ParseEvents(k, "kill", "STOP"); len(evs) > 0 {
 		p.Options.AddHandler(b.KillEvent, &pipe.Handler{
 			Pre:   true,
 			Order: math.MinInt + 1,
@@ -263,7 +269,7 @@ func (s *StageBase) attach() error {
 	s.wgAdd(1)
 
 	// has trigger-on events?
-	if evs := b.parseEvents(k, "wait", "START"); len(evs) > 0 {
+	if evs := b.ParseEvents(k, "wait", "START"); len(evs) > 0 {
 		po.OnEventPre(s.runStart, evs...)
 
 		// trigger pipe start handlers by --wait events
@@ -279,7 +285,7 @@ func (s *StageBase) attach() error {
 	}
 
 	// has trigger-off events?
-	if evs := b.parseEvents(k, "stop", "STOP"); len(evs) > 0 {
+	if evs := b.ParseEvents(k, "stop", "STOP"); len(evs) > 0 {
 		po.OnEventPost(s.runStop, evs...)
 	}
 
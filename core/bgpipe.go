@@ -89,7 +89,19 @@ func (b *Bgpipe) Run() error {
 	b.Pipe.Start() // will call b.Start
 	b.Pipe.Wait()  // until error or all processing is done
 
-	// TODO: wait until all pipe output is read
+	// wait until all pipe output is read: stop the stages still running,
+	// eg. to flush and close their output files (in parallel, as each can take 1s)
+	var wg sync.WaitGroup
+	for _, s := range b.Stages {
+		if s != nil {
+			wg.Add(1)
+			go func(s *StageBase) {
+				s.runStop(nil)
+				wg.Done()
+			}(s)
+		}
+	}
+	wg.Wait()
 
 	// any errors on the global context?
 	err := context.Cause(b.Ctx)
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+var (
+	// peer connected, value is *Peer
+	EVENT_PEER_UP = "bgpipe/peer.UP"
+
+	// peer disconnected, value is *Peer
+	EVENT_PEER_DOWN = "bgpipe/peer.DOWN"
+)
+
+// Peer describes a BGP speaker connected to the pipe by a stage, eg. over TCP.
+// Published in the pipe KV store; treat as read-only.
+type Peer struct {
+	Stage      *StageBase     // stage handling the connection
+	Dir        msg.Dir        // direction of messages received from the peer
+	LocalAddr  netip.AddrPort // our address
+	RemoteAddr netip.AddrPort // peer address
+	LocalASN   uint32         // our ASN, from the OPEN sent to the peer (may be zero)
+	RemoteASN  uint32         // peer ASN, from the OPEN received from the peer (may be zero)
+}
+
+// peerKey returns the pipe KV key for the peer sending messages in direction dir
+func peerKey(dir msg.Dir) string {
+	return "bgpipe/peer/" + dir.String()
+}
+
+// GetPeer returns the peer that sends messages in direction dir, or nil if not connected
+func (b *Bgpipe) GetPeer(dir msg.Dir) *Peer {
+	if v, ok := b.Pipe.KV.Load(peerKey(dir)); ok {
+		peer, _ := v.(*Peer)
+		return peer
+	}
+	return nil
+}
+
+// PeerUp publishes the peer connected to s over conn and emits EVENT_PEER_UP.
+// The peer ASNs are updated later, as OPEN messages are seen in the pipe.
+func (s *StageBase) PeerUp(conn net.Conn) *Peer {
+	peer := &Peer{
+		Stage:      s,
+		Dir:        s.Dir,
+		LocalAddr:  addrPort(conn.LocalAddr()),
+		RemoteAddr: addrPort(conn.RemoteAddr()),
+	}
+
+	// already seen the OPENs?
+	if o := s.P.LineFor(peer.Dir).Open.Load(); o != nil {
+		peer.RemoteASN = uint32(o.GetASN())
+	}
+	if o := s.P.LineFor(peer.Dir.Flip()).Open.Load(); o != nil {
+		peer.LocalASN = uint32(o.GetASN())
+	}
+
+	s.P.KV.Store(peerKey(peer.Dir), peer)
+	s.P.Event(EVENT_PEER_UP, peer.Dir, peer, s)
+	return peer
+}
+
+// PeerDown removes the peer connected to s and emits EVENT_PEER_DOWN
+func (s *StageBase) PeerDown() {
+	v, ok := s.P.KV.LoadAndDelete(peerKey(s.Dir))
+	if peer, _ := v.(*Peer); ok && peer != nil {
+		s.P.Event(EVENT_PEER_DOWN, peer.Dir, peer, s)
+	}
+}
+
+// onOpen updates the peer ASNs using the OPEN message seen in ev.Dir
+func (b *Bgpipe) onOpen(ev *pipe.Event) bool {
+	o := b.Pipe.LineFor(ev.Dir).Open.Load()
+	if o == nil {
+		return true
+	}
+	asn := uint32(o.GetASN())
+
+	// the peer that sent it
+	if peer := b.GetPeer(ev.Dir); peer != nil && peer.RemoteASN != asn {
+		peer2 := *peer
+		peer2.RemoteASN = asn
+		b.Pipe.KV.Store(peerKey(ev.Dir), &peer2)
+	}
+
+	// the peer that received it
+	if peer := b.GetPeer(ev.Dir.Flip()); peer != nil && peer.LocalASN != asn {
+		peer2 := *peer
+		peer2.LocalASN = asn
+		b.Pipe.KV.Store(peerKey(ev.Dir.Flip()), &peer2)
+	}
+
+	return true
+}
+
+// addrPort returns addr as netip.AddrPort, or an invalid value if not possible
+func addrPort(addr net.Addr) (ap netip.AddrPort) {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ap = v.AddrPort()
+	case *net.UDPAddr:
+		ap = v.AddrPort()
+	case nil:
+		return
+	default:
+		ap, _ = netip.ParseAddrPort(addr.String())
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
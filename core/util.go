@@ -47,8 +47,8 @@ func IsFile(v string) bool {
 	}
 }
 
-// parseEvents returns events from given koanf key, or nil if none found
-func (b *Bgpipe) parseEvents(k *koanf.Koanf, key string, sds ...string) []string {
+// ParseEvents returns events from given koanf key, or nil if none found
+func (b *Bgpipe) ParseEvents(k *koanf.Koanf, key string, sds ...string) []string {
 	input := k.Strings(key)
 	if len(input) == 0 {
 		return nil
@@ -99,6 +99,6 @@ func (b *Bgpipe) parseEvents(k *koanf.Koanf, key string, sds ...string) []string
 		output = append(output, et)
 	}
 
-	b.Trace().Msgf("parseEvents(): %s -> %s", input, output)
+	b.Trace().Msgf("ParseEvents(): %s -> %s", input, output)
 	return output
 }
@@ -0,0 +1,316 @@
+package extio
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/parquet-go/parquet-go"
+	"github.com/valyala/bytebufferpool"
+)
+
+// csvHeader lists the columns of --csv and --parquet output
+var csvHeader = []string{
+	"time", "dir", "seq", "action", "prefix",
+	"aspath", "origin", "nexthop", "communities", "tags",
+}
+
+// prefixRow represents a single row of --csv and --parquet output,
+// ie. a single prefix announced or withdrawn in a BGP UPDATE
+type prefixRow struct {
+	Time        int64  `parquet:"time,timestamp(microsecond)"`
+	Dir         string `parquet:"dir,dict"`
+	Seq         int64  `parquet:"seq"`
+	Action      string `parquet:"action,dict"`
+	Prefix      string `parquet:"prefix"`
+	Aspath      string `parquet:"aspath"`
+	Origin      uint32 `parquet:"origin"`
+	Nexthop     string `parquet:"nexthop"`
+	Communities string `parquet:"communities"`
+	Tags        string `parquet:"tags"`
+}
+
+// parquet_ROWGROUP is the max. number of rows in a parquet row group
+const parquet_ROWGROUP = 100000
+
+// writeCsv writes m to bb as CSV rows, one per prefix in a BGP UPDATE.
+// Other messages and UPDATEs without prefixes produce no output.
+func (eio *Extio) writeCsv(bb *bytebufferpool.ByteBuffer, m *msg.Msg) error {
+	if m.Type != msg.UPDATE {
+		return nil
+	} else if err := m.Parse(eio.P.Caps); err != nil {
+		return err
+	}
+
+	// common columns
+	ats := &m.Update.Attrs
+	row := []string{
+		m.Time.UTC().Format(time.RFC3339Nano),
+		m.Dir.String(),
+		strconv.FormatInt(m.Seq, 10),
+		"", // action
+		"", // prefix
+		csvAspath(ats.AsPath()),
+		"", // origin
+		"", // nexthop
+		csvCommunities(ats),
+		csvTags(m),
+	}
+	if origin := ats.AsOrigin(); origin != 0 {
+		row[6] = strconv.FormatUint(uint64(origin), 10)
+	}
+
+	cw := csv.NewWriter(bb)
+	csvPrefixes(&m.Update, func(action string, nh netip.Addr, prefixes []netip.Prefix) {
+		row[3] = action
+		row[7] = ""
+		if nh.IsValid() {
+			row[7] = nh.String()
+		}
+		for _, p := range prefixes {
+			row[4] = p.String()
+			cw.Write(row)
+		}
+	})
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeParquet writes m to bb as prefixRows, one per prefix in a BGP UPDATE,
+// for parquetWriter. Other messages and UPDATEs without prefixes produce no output.
+func (eio *Extio) writeParquet(bb *bytebufferpool.ByteBuffer, m *msg.Msg) error {
+	if m.Type != msg.UPDATE {
+		return nil
+	} else if err := m.Parse(eio.P.Caps); err != nil {
+		return err
+	}
+
+	// common columns
+	ats := &m.Update.Attrs
+	row := prefixRow{
+		Time:        m.Time.UnixMicro(),
+		Dir:         m.Dir.String(),
+		Seq:         m.Seq,
+		Aspath:      csvAspath(ats.AsPath()),
+		Origin:      ats.AsOrigin(),
+		Communities: csvCommunities(ats),
+		Tags:        csvTags(m),
+	}
+
+	csvPrefixes(&m.Update, func(action string, nh netip.Addr, prefixes []netip.Prefix) {
+		row.Action = action
+		row.Nexthop = ""
+		if nh.IsValid() {
+			row.Nexthop = nh.String()
+		}
+		for _, p := range prefixes {
+			row.Prefix = p.String()
+			bb.B = row.append(bb.B)
+		}
+	})
+	return nil
+}
+
+// csvPrefixes calls cb for the withdrawn and announced prefixes in u, with their next-hop
+func csvPrefixes(u *msg.Update, cb func(action string, nh netip.Addr, prefixes []netip.Prefix)) {
+	ats := &u.Attrs
+
+	// IPv4 unicast
+	var nh netip.Addr
+	if ip, ok := ats.Get(attrs.ATTR_NEXTHOP).(*attrs.IP); ok {
+		nh = ip.Addr
+	}
+	cb("withdraw", netip.Addr{}, u.Unreach)
+	cb("announce", nh, u.Reach)
+
+	// MP-BGP
+	if mp := ats.MPPrefixes(attrs.ATTR_MP_UNREACH); mp != nil {
+		cb("withdraw", netip.Addr{}, mp.Prefixes)
+	}
+	if mp := ats.MPPrefixes(attrs.ATTR_MP_REACH); mp != nil {
+		cb("announce", mp.NextHop, mp.Prefixes)
+	}
+}
+
+// append appends r to buf in the internal binary format of writeParquet
+func (r *prefixRow) append(buf []byte) []byte {
+	buf = binary.AppendVarint(buf, r.Time)
+	buf = binary.AppendVarint(buf, r.Seq)
+	buf = binary.AppendUvarint(buf, uint64(r.Origin))
+	for _, v := range []string{r.Dir, r.Action, r.Prefix, r.Aspath, r.Nexthop, r.Communities, r.Tags} {
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+	return buf
+}
+
+// read reads r from buf written by append, returning the number of bytes read
+func (r *prefixRow) read(buf []byte) (n int, err error) {
+	varint := func() int64 {
+		v, l := binary.Varint(buf[n:])
+		if l <= 0 {
+			err = ErrFormat
+			return 0
+		}
+		n += l
+		return v
+	}
+	uvarint := func() uint64 {
+		v, l := binary.Uvarint(buf[n:])
+		if l <= 0 {
+			err = ErrFormat
+			return 0
+		}
+		n += l
+		return v
+	}
+
+	r.Time = varint()
+	r.Seq = varint()
+	r.Origin = uint32(uvarint())
+	for _, v := range []*string{&r.Dir, &r.Action, &r.Prefix, &r.Aspath, &r.Nexthop, &r.Communities, &r.Tags} {
+		l := uvarint()
+		if err != nil || l > uint64(len(buf)-n) {
+			return n, ErrFormat
+		}
+		*v = string(buf[n : n+int(l)])
+		n += int(l)
+	}
+	return n, err
+}
+
+// csvAspath returns asp in bgpdump-like format, eg. "65001 65002 {65003,65004}"
+func csvAspath(asp *attrs.Aspath) string {
+	if asp == nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	for i := range asp.Segments {
+		seg := &asp.Segments[i]
+		if seg.IsSet {
+			if sb.Len() > 0 {
+				sb.WriteByte(' ')
+			}
+			sb.WriteByte('{')
+			for j, asn := range seg.List {
+				if j > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(strconv.FormatUint(uint64(asn), 10))
+			}
+			sb.WriteByte('}')
+		} else {
+			for _, asn := range seg.List {
+				if sb.Len() > 0 {
+					sb.WriteByte(' ')
+				}
+				sb.WriteString(strconv.FormatUint(uint64(asn), 10))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// csvCommunities returns standard and large communities in ats, separated by spaces
+func csvCommunities(ats *attrs.Attrs) string {
+	var sb strings.Builder
+	add := func(vals ...uint32) {
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		for i, v := range vals {
+			if i > 0 {
+				sb.WriteByte(':')
+			}
+			sb.WriteString(strconv.FormatUint(uint64(v), 10))
+		}
+	}
+
+	if com, ok := ats.Get(attrs.ATTR_COMMUNITY).(*attrs.Community); ok {
+		for i := range com.ASN {
+			add(uint32(com.ASN[i]), uint32(com.Value[i]))
+		}
+	}
+	if com, ok := ats.Get(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom); ok {
+		for i := range com.ASN {
+			add(com.ASN[i], com.Value1[i], com.Value2[i])
+		}
+	}
+	return sb.String()
+}
+
+// csvTags returns message tags as a JSON object, or empty string if none
+func csvTags(m *msg.Msg) string {
+	if !pipe.HasTags(m) {
+		return ""
+	}
+	buf, err := json.Marshal(pipe.MsgTags(m))
+	if err != nil {
+		return ""
+	}
+	return string(buf)
+}
+
+// parquetWriter converts rows written by writeParquet into a parquet file
+type parquetWriter struct {
+	pw   *parquet.GenericWriter[prefixRow]
+	rows []prefixRow
+	todo int // rows left till next row group
+}
+
+func newParquetWriter(w io.Writer) *parquetWriter {
+	return &parquetWriter{
+		pw:   parquet.NewGenericWriter[prefixRow](w),
+		todo: parquet_ROWGROUP,
+	}
+}
+
+// Write reads complete rows in buf and writes them as parquet rows
+func (pw *parquetWriter) Write(buf []byte) (int, error) {
+	pw.rows = pw.rows[:0]
+	for off := 0; off < len(buf); {
+		var row prefixRow
+		n, err := row.read(buf[off:])
+		if err != nil {
+			return 0, err
+		}
+		pw.rows = append(pw.rows, row)
+		off += n
+	}
+
+	if _, err := pw.pw.Write(pw.rows); err != nil {
+		return 0, err
+	}
+
+	// start a new row group?
+	if pw.todo -= len(pw.rows); pw.todo <= 0 {
+		pw.todo = parquet_ROWGROUP
+		if err := pw.pw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(buf), nil
+}
+
+// Close writes the parquet footer; it does not close the underlying writer
+func (pw *parquetWriter) Close() error {
+	return pw.pw.Close()
+}
+
+// nopCloser wraps an io.Writer with a no-op Close
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -5,4 +5,5 @@ import "errors"
 var (
 	ErrFormat = errors.New("unrecognized format")
 	ErrLength = errors.New("invalid buffer length")
+	ErrStream = errors.New("format requires a byte stream")
 )
@@ -2,10 +2,16 @@ package extio
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/csv"
 	"fmt"
 	"io"
+	"net/netip"
+	"os"
 	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bgpfix/bgpfix/caps"
@@ -24,28 +30,63 @@ var bbpool bytebufferpool.Pool
 type Extio struct {
 	*core.StageBase
 
-	mode       Mode
-	opt_type   []msg.Type // --type
-	opt_raw    bool       // --raw
-	opt_mrt    bool       // --mrt
-	opt_read   bool       // --read
-	opt_write  bool       // --write
-	opt_copy   bool       // --copy
-	opt_noseq  bool       // --no-seq
-	opt_notime bool       // --no-time
-	opt_notags bool       // --no-tags
-	opt_pardon bool       // --pardon
-
-	mrt *mrt.Reader  // MRT reader
-	buf bytes.Buffer // for ReadBuf()
+	mode        Mode
+	opt_type    []msg.Type // --type
+	opt_raw     bool       // --raw
+	opt_mrt     bool       // --mrt
+	opt_pcap    bool       // --pcap
+	opt_proto   bool       // --proto
+	opt_csv     bool       // --csv
+	opt_pq      bool       // --parquet
+	opt_bgpdump bool       // --bgpdump
+	opt_pretty  bool       // --pretty
+	opt_read    bool       // --read
+	opt_write   bool       // --write
+	opt_copy    bool       // --copy
+	opt_noseq   bool       // --no-seq
+	opt_notime  bool       // --no-time
+	opt_notags  bool       // --no-tags
+	opt_pardon  bool       // --pardon
+
+	opt_overflow Overflow      // --overflow
+	opt_ovtime   time.Duration // --overflow-timeout
+
+	opt_peerip  []netip.Prefix // --peer-ip
+	opt_peeras  []uint32       // --peer-asn
+	opt_localip []netip.Prefix // --local-ip
+
+	mrt   *mrt.Reader  // MRT reader
+	pcap  *pcapReader  // pcap reader
+	pcapw pcapWriter   // pcap writer
+	buf   bytes.Buffer // for ReadBuf()
+
+	established atomic.Bool // seen EVENT_ESTABLISHED? (for MRT state changes)
+
+	rejects   *rejects     // --rejects file
+	nread     atomic.Int64 // input line (or message) counter
+	nrejected atomic.Int64 // rejected input counter
+	ndropped  atomic.Int64 // output messages dropped due to --overflow
+	lastdrop  atomic.Int64 // unix time of the last OUTPUT_DROP event
 
 	Callback *pipe.Callback // our callback for capturing bgpipe output
 	InputL   *pipe.Input    // our L input to bgpipe
 	InputR   *pipe.Input    // our R input to bgpipe
 	InputD   *pipe.Input    // default input if data doesn't specify the direction
 
+	Bypass atomic.Bool                     // if true, SendMsg passes messages through untouched
+	Color  bool                            // use terminal colors in --pretty output
+	Source string                          // default input source for --rejects, eg. file path
 	Output chan *bytebufferpool.ByteBuffer // output ready to be sent to the process
 	Pool   *bytebufferpool.Pool            // pool of byte buffers
+
+	Shards []chan *bytebufferpool.ByteBuffer // if set, output goes to Shards[Shard(m)] instead of Output
+	Shard  func(m *msg.Msg) int              // selects the Shards index for m, or <0 to pass m through untouched
+
+	// if set, SendMsg calls Router instead of queueing bb in Output, eg. to route m to
+	// multiple queues using Queue(). Router must dispose of bb, and return false iff
+	// the output is closed. m is nil if bb is not a BGP message, eg. an MRT state change.
+	// If set before Attach, --overflow defaults to drop-oldest.
+	Router func(m *msg.Msg, bb *bytebufferpool.ByteBuffer) bool
 }
 
 type Mode = int
@@ -71,6 +112,8 @@ func NewExtio(parent *core.StageBase, mode Mode) *Extio {
 	if f.Lookup("raw") == nil {
 		f.Bool("raw", false, "speak raw BGP instead of JSON")
 		f.Bool("mrt", false, "speak MRT-BGP4MP instead of JSON")
+		f.Bool("pcap", false, "speak pcap (BGP over TCP/IP packets) instead of JSON")
+		f.Bool("proto", false, "speak length-delimited Protobuf (see bgpipe.proto) instead of JSON")
 		f.StringSlice("type", []string{}, "skip if message is not of specified type(s)")
 
 		if mode&(MODE_READ|MODE_WRITE) == 0 {
@@ -78,6 +121,16 @@ func NewExtio(parent *core.StageBase, mode Mode) *Extio {
 			f.Bool("write", false, "write-only mode (no input to bgpipe)")
 		}
 
+		if mode&MODE_READ == 0 {
+			f.Bool("csv", false, "write CSV with one row per UPDATE prefix instead of JSON")
+			f.Bool("parquet", false, "write Parquet with one row per UPDATE prefix instead of JSON")
+			f.Bool("bgpdump", false, "write text compatible with bgpdump -m instead of JSON")
+			f.Bool("pretty", false, "write human-readable text instead of JSON")
+			f.Int("queue", 100, "output queue size (messages)")
+			f.String("overflow", "", "full output queue policy: block, drop-newest, drop-oldest, disconnect (default block, or drop-oldest with --copy or in server mode)")
+			f.Duration("overflow-timeout", 5*time.Second, "how long to block before --overflow disconnect")
+		}
+
 		if mode&MODE_READ == 0 && mode&MODE_COPY == 0 {
 			f.Bool("copy", false, "copy messages instead of filtering (mirror)")
 		}
@@ -87,9 +140,26 @@ func NewExtio(parent *core.StageBase, mode Mode) *Extio {
 			f.Bool("no-seq", false, "overwrite input message sequence number")
 			f.Bool("no-time", false, "overwrite input message time")
 			f.Bool("no-tags", false, "drop input message tags")
+			f.StringSlice("peer-ip", []string{}, "skip if BGP4MP peer IP is not in given prefix(es)")
+			f.StringSlice("peer-asn", []string{}, "skip if BGP4MP peer ASN is not one of given")
+			f.StringSlice("local-ip", []string{}, "skip if BGP4MP local IP is not in given prefix(es)")
+			f.String("rejects", "", "write rejected input to given file")
 		}
 	}
 
+	// add events iff needed
+	o := &eio.Options
+	if o.Events == nil {
+		o.Events = make(map[string]string)
+	}
+	if mode&MODE_WRITE == 0 {
+		o.Events["PARSE_ERROR"] = "input parse error (value: count, source, line)"
+	}
+	if mode&MODE_READ == 0 {
+		o.Events["OUTPUT_DROP"] = "output dropped due to --overflow (value: total count)"
+		o.Events["OUTPUT_DISCONNECT"] = "output closed due to --overflow disconnect"
+	}
+
 	return eio
 }
 
@@ -101,6 +171,12 @@ func (eio *Extio) Attach() error {
 	// options
 	eio.opt_raw = k.Bool("raw")
 	eio.opt_mrt = k.Bool("mrt")
+	eio.opt_pcap = k.Bool("pcap")
+	eio.opt_proto = k.Bool("proto")
+	eio.opt_csv = k.Bool("csv")
+	eio.opt_pq = k.Bool("parquet")
+	eio.opt_bgpdump = k.Bool("bgpdump")
+	eio.opt_pretty = k.Bool("pretty")
 	eio.opt_read = k.Bool("read")
 	eio.opt_write = k.Bool("write")
 	eio.opt_copy = k.Bool("copy")
@@ -144,6 +220,47 @@ func (eio *Extio) Attach() error {
 		return fmt.Errorf("--type: %w", err)
 	}
 
+	// output queue
+	var err error
+	if eio.mode&MODE_READ == 0 {
+		if n := k.Int("queue"); n < 1 {
+			return fmt.Errorf("--queue: must be at least 1")
+		} else {
+			eio.Output = make(chan *bytebufferpool.ByteBuffer, n)
+		}
+		// never stall the pipe on a slow mirror or server client,
+		// but keep file and stdout output complete
+		ov := k.String("overflow")
+		if ov == "" && (eio.Router != nil || (eio.opt_copy || eio.opt_write) && eio.mode&MODE_WRITE == 0) {
+			ov = "drop-oldest"
+		}
+		eio.opt_overflow, err = parseOverflow(ov)
+		if err != nil {
+			return fmt.Errorf("--overflow: %w", err)
+		}
+		eio.opt_ovtime = k.Duration("overflow-timeout")
+		if eio.opt_overflow == OVERFLOW_DISCONNECT && eio.opt_ovtime <= 0 {
+			return fmt.Errorf("--overflow-timeout: must be positive")
+		}
+	}
+
+	// parse BGP4MP peer selectors
+	eio.opt_peerip, err = ParsePrefixes(k.Strings("peer-ip"))
+	if err != nil {
+		return fmt.Errorf("--peer-ip: %w", err)
+	}
+	eio.opt_localip, err = ParsePrefixes(k.Strings("local-ip"))
+	if err != nil {
+		return fmt.Errorf("--local-ip: %w", err)
+	}
+	for _, v := range k.Strings("peer-asn") {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(v), "AS"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("--peer-asn: %w", err)
+		}
+		eio.opt_peeras = append(eio.opt_peeras, uint32(asn))
+	}
+
 	// check options
 	if eio.opt_read || eio.opt_write {
 		if eio.opt_read && eio.opt_write {
@@ -152,12 +269,33 @@ func (eio *Extio) Attach() error {
 			eio.opt_copy = true // read/write-only doesn't make sense without --copy
 		}
 	}
-	if eio.opt_raw && eio.opt_mrt {
-		return fmt.Errorf("--raw and --mrt: must not use both at the same time")
+	formats := 0
+	for _, v := range []bool{eio.opt_raw, eio.opt_mrt, eio.opt_pcap, eio.opt_proto, eio.opt_csv, eio.opt_pq, eio.opt_bgpdump, eio.opt_pretty} {
+		if v {
+			formats++
+		}
+	}
+	if formats > 1 {
+		return fmt.Errorf("--raw, --mrt, --pcap, --proto, --csv, --parquet, --bgpdump, and --pretty: must not use more than one at the same time")
+	}
+	if (eio.opt_csv || eio.opt_pq || eio.opt_bgpdump || eio.opt_pretty) && !eio.opt_write {
+		return fmt.Errorf("--csv, --parquet, --bgpdump, and --pretty: output only, must be used with --write")
+	}
+	if eio.opt_pq && eio.mode&MODE_WRITE == 0 {
+		return fmt.Errorf("--parquet: needs a file footer, only supported by write and stdout")
 	}
 
 	// not write-only? read input to bgpipe
 	if !eio.opt_write {
+		// write rejected input to file?
+		if path := k.String("rejects"); len(path) > 0 {
+			fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+			if err != nil {
+				return fmt.Errorf("--rejects: %w", err)
+			}
+			eio.rejects = &rejects{fh: fh}
+		}
+
 		if eio.IsBidir {
 			eio.InputL = p.AddInput(msg.DIR_L)
 			eio.InputR = p.AddInput(msg.DIR_R)
@@ -176,13 +314,21 @@ func (eio *Extio) Attach() error {
 			eio.InputD = eio.InputR
 		}
 
+		// NB: need the BGP4MP tags for peer selection, checkMsg() drops them if needed
 		eio.mrt = mrt.NewReader(p, eio.InputD)
-		eio.mrt.NoTags = eio.opt_notags
+		eio.mrt.NoTags = eio.opt_notags && !eio.hasPeerFilter()
+		eio.pcap = newPcapReader(eio)
 	}
 
 	// not read-only? write bgpipe output
 	if !eio.opt_read {
 		eio.Callback = p.OnMsg(eio.SendMsg, eio.Dir, eio.opt_type...)
+
+		// write BGP4MP state changes?
+		if eio.opt_mrt {
+			p.OnEvent(eio.onEstablished, pipe.EVENT_ESTABLISHED)
+			p.OnEvent(eio.onPeerDown, core.EVENT_PEER_DOWN)
+		}
 	}
 
 	return nil
@@ -192,10 +338,101 @@ func (eio *Extio) Attach() error {
 // Does not keep a reference to buf (copies buf if needed).
 // Can be used concurrently. cb may be nil.
 func (eio *Extio) ReadSingle(buf []byte, cb pipe.CallbackFunc) (parse_err error) {
+	return eio.ReadSingleFrom("", buf, cb)
+}
+
+// ReadSingleFrom is ReadSingle for input from given source, eg. a remote address.
+// If src is empty, eio.Source is used.
+func (eio *Extio) ReadSingleFrom(src string, buf []byte, cb pipe.CallbackFunc) (parse_err error) {
+	return eio.readSingle(src, buf, cb, eio.WriteInput, eio.opt_pardon)
+}
+
+// ReadSingleStrict is ReadSingleFrom that returns parse errors even with --pardon,
+// eg. to report them back to the remote. Rejects are still written as usual.
+func (eio *Extio) ReadSingleStrict(src string, buf []byte, cb pipe.CallbackFunc) (parse_err error) {
+	return eio.readSingle(src, buf, cb, eio.WriteInput, false)
+}
+
+// ReadBatchFrom is ReadSingleFrom for buf with zero or more messages packed back-to-back,
+// eg. a websocket frame with a batch of messages. Stops on the first error.
+func (eio *Extio) ReadBatchFrom(src string, buf []byte, cb pipe.CallbackFunc) (parse_err error) {
+	for len(buf) > 0 {
+		l := eio.nextSingle(buf)
+		if parse_err = eio.readSingle(src, buf[:l], cb, eio.WriteInput, eio.opt_pardon); parse_err != nil {
+			return parse_err
+		}
+		buf = buf[l:]
+	}
+	return nil
+}
+
+// nextSingle returns the length of the first message in buf, or len(buf) if unknown
+func (eio *Extio) nextSingle(buf []byte) int {
+	var l int
+	switch {
+	case eio.opt_raw:
+		if len(buf) >= msg.HEADLEN {
+			l = int(binary.BigEndian.Uint16(buf[16:18]))
+		}
+	case eio.opt_mrt:
+		if len(buf) >= mrt.HEADLEN {
+			l = mrt.HEADLEN + int(binary.BigEndian.Uint32(buf[8:12]))
+		}
+	case eio.opt_pcap:
+		// can't split
+	case eio.opt_proto:
+		l, _ = protoNext(buf)
+	default:
+		l = bytes.IndexByte(buf, '\n') + 1
+	}
+
+	if l <= 0 || l > len(buf) {
+		return len(buf) // let readSingle() deal with it
+	}
+	return l
+}
+
+// streamNext returns the length of the first message in stream buf, or 0 if buf needs more data
+func (eio *Extio) streamNext(buf []byte) (int, error) {
+	var l int
+	switch {
+	case eio.opt_proto:
+		return protoNext(buf)
+	case eio.opt_raw:
+		if len(buf) < msg.HEADLEN {
+			return 0, nil
+		}
+		l = int(binary.BigEndian.Uint16(buf[16:18]))
+		if l < msg.HEADLEN {
+			return 0, ErrLength
+		}
+	case eio.opt_mrt:
+		if len(buf) < mrt.HEADLEN {
+			return 0, nil
+		}
+		l = mrt.HEADLEN + int(binary.BigEndian.Uint32(buf[8:12]))
+		if l > proto_MAXLEN {
+			return 0, ErrLength
+		}
+	default:
+		return bytes.IndexByte(buf, '\n') + 1, nil
+	}
+
+	if l > len(buf) {
+		return 0, nil // need more data
+	}
+	return l, nil
+}
+
+// readSingle implements ReadSingleFrom, passing the resulting message to inject.
+// If pardon is true, parse errors are rejected but not returned.
+func (eio *Extio) readSingle(src string, buf []byte, cb pipe.CallbackFunc, inject func(m *msg.Msg) error, pardon bool) (parse_err error) {
 	// write-only to process?
 	if eio.opt_write {
 		return nil
 	}
+	line := eio.nread.Add(1)
+	input := buf
 
 	// use callback?
 	check := eio.checkMsg
@@ -226,6 +463,12 @@ func (eio *Extio) ReadSingle(buf []byte, cb pipe.CallbackFunc) (parse_err error)
 			parse_err = ErrLength // dangling bytes after msg?
 		}
 
+	} else if eio.opt_pcap { // pcap needs TCP reassembly
+		parse_err = ErrStream
+
+	} else if eio.opt_proto { // Protobuf message
+		parse_err = eio.readProto(buf, m)
+
 	} else { // parse text in buf into m
 		buf = bytes.TrimSpace(buf)
 		switch {
@@ -234,7 +477,8 @@ func (eio *Extio) ReadSingle(buf []byte, cb pipe.CallbackFunc) (parse_err error)
 			return nil
 		case buf[0] == '[': // a BGP message
 			// TODO: optimize unmarshal (lookup cache of recently marshaled msgs)
-			parse_err = m.FromJSON(buf)
+			// NB: copy buf, as message tags may reference it
+			parse_err = m.FromJSON(bytes.Clone(buf))
 
 			// convenience
 			if parse_err == nil && m.Type == msg.INVALID {
@@ -252,14 +496,18 @@ func (eio *Extio) ReadSingle(buf []byte, cb pipe.CallbackFunc) (parse_err error)
 
 	// parse error?
 	if parse_err != nil {
-		if eio.opt_pardon {
-			parse_err = nil
-		} else if eio.opt_raw {
+		eio.reject(src, line, input, parse_err)
+		switch {
+		case eio.opt_pardon: // silent
+		case eio.opt_raw || eio.opt_proto:
 			eio.Err(parse_err).Hex("input", buf).Msg("input read single error")
-		} else {
+		default:
 			eio.Err(parse_err).Bytes("input", buf).Msg("input read single error")
 		}
 		eio.P.PutMsg(m)
+		if pardon {
+			return nil
+		}
 		return parse_err
 	}
 
@@ -271,6 +519,11 @@ func (eio *Extio) ReadSingle(buf []byte, cb pipe.CallbackFunc) (parse_err error)
 
 	// sail!
 	m.CopyData()
+	return inject(m)
+}
+
+// WriteInput writes m to bgpipe, using the input for m.Dir.
+func (eio *Extio) WriteInput(m *msg.Msg) error {
 	switch m.Dir {
 	case msg.DIR_L:
 		return eio.InputL.WriteMsg(m)
@@ -289,15 +542,14 @@ func (eio *Extio) ReadBuf(buf []byte, cb pipe.CallbackFunc) (parse_err error) {
 		return nil
 	}
 
-	check := eio.checkMsg
-	if cb != nil {
-		check = func(m *msg.Msg) bool {
-			return eio.checkMsg(m) && cb(m)
-		}
+	check := func(m *msg.Msg) bool {
+		eio.nread.Add(1)
+		return eio.checkMsg(m) && (cb == nil || cb(m))
 	}
 
 	// raw message?
-	if eio.opt_raw { // raw message(s)
+	var rejected []byte // input rejected due to parse_err (the whole chunk for streams)
+	if eio.opt_raw {    // raw message(s)
 		_, err := eio.InputD.WriteFunc(buf, check)
 		switch err {
 		case nil:
@@ -306,6 +558,7 @@ func (eio *Extio) ReadBuf(buf []byte, cb pipe.CallbackFunc) (parse_err error) {
 			return nil // wait for more
 		default:
 			parse_err = err
+			rejected = buf
 		}
 	} else if eio.opt_mrt { // MRT message(s)
 		_, err := eio.mrt.WriteFunc(buf, check)
@@ -316,6 +569,30 @@ func (eio *Extio) ReadBuf(buf []byte, cb pipe.CallbackFunc) (parse_err error) {
 			return nil // wait for more
 		default:
 			parse_err = err
+			rejected = buf
+		}
+	} else if eio.opt_pcap { // pcap packet(s)
+		_, err := eio.pcap.WriteFunc(buf, check)
+		if err != nil {
+			parse_err = err
+			rejected = buf
+		}
+	} else if eio.opt_proto { // buffer and parse all messages in buf so far
+		eio.buf.Write(buf)
+		for {
+			n, err := protoNext(eio.buf.Bytes())
+			if err != nil {
+				parse_err = err
+				rejected = bytes.Clone(eio.buf.Bytes())
+				eio.buf.Reset() // can't recover
+				break
+			} else if n == 0 {
+				break // wait for more
+			}
+			err = eio.ReadSingle(eio.buf.Next(n), cb)
+			if err != nil {
+				return err
+			}
 		}
 	} else { // buffer and parse all lines in buf so far
 		eio.buf.Write(buf)
@@ -332,9 +609,12 @@ func (eio *Extio) ReadBuf(buf []byte, cb pipe.CallbackFunc) (parse_err error) {
 	}
 
 	// parse error?
-	if parse_err != nil && !eio.opt_pardon {
-		eio.Err(parse_err).Msg("input read stream error")
-		return parse_err
+	if parse_err != nil {
+		eio.reject("", eio.nread.Load()+1, rejected, parse_err)
+		if !eio.opt_pardon {
+			eio.Err(parse_err).Msg("input read stream error")
+			return parse_err
+		}
 	}
 
 	return nil
@@ -368,12 +648,71 @@ func (eio *Extio) ReadStream(rd io.Reader, cb pipe.CallbackFunc) (parse_err erro
 	}
 }
 
+// ReadStreamSingle is like ReadStream, but splits rd into single messages using its
+// own buffer, and passes them to ReadSingle. Unlike ReadStream, it can be used
+// concurrently. Does not support --pcap.
+// If inject is not nil, it is called instead of writing the messages to bgpipe.
+func (eio *Extio) ReadStreamSingle(rd io.Reader, cb pipe.CallbackFunc, inject func(m *msg.Msg) error) error {
+	return eio.ReadStreamSingleFrom("", rd, cb, inject)
+}
+
+// ReadStreamSingleFrom is ReadStreamSingle for input from given source, eg. a remote address.
+func (eio *Extio) ReadStreamSingleFrom(src string, rd io.Reader, cb pipe.CallbackFunc, inject func(m *msg.Msg) error) error {
+	if eio.opt_pcap {
+		return ErrFormat
+	}
+
+	if inject == nil {
+		inject = eio.WriteInput
+	}
+
+	var (
+		buf = make([]byte, 64*1024)
+		bb  bytes.Buffer
+	)
+	for {
+		n, err := rd.Read(buf)
+		bb.Write(buf[:n])
+
+		// parse all complete messages so far
+		for {
+			l, parse_err := eio.streamNext(bb.Bytes())
+			if parse_err != nil {
+				eio.reject(src, eio.nread.Load()+1, bb.Bytes(), parse_err)
+				if !eio.opt_pardon {
+					return parse_err
+				}
+				bb.Reset() // can't recover
+				break
+			}
+			if l == 0 {
+				break // wait for more
+			}
+			if parse_err := eio.readSingle(src, bb.Next(l), cb, inject, eio.opt_pardon); parse_err != nil {
+				return parse_err
+			}
+		}
+
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+}
+
 func (eio *Extio) checkMsg(m *msg.Msg) bool {
 	// filter message types?
 	if len(eio.opt_type) > 0 && slices.Index(eio.opt_type, m.Type) < 0 {
 		return false
 	}
 
+	// select BGP4MP peers?
+	if eio.hasPeerFilter() && !eio.checkPeer(m) {
+		return false
+	}
+
 	// overwrite message metadata?
 	if eio.opt_noseq {
 		m.Seq = 0
@@ -389,13 +728,51 @@ func (eio *Extio) checkMsg(m *msg.Msg) bool {
 	return true
 }
 
+// hasPeerFilter returns true iff any of the BGP4MP peer selectors is set
+func (eio *Extio) hasPeerFilter() bool {
+	return len(eio.opt_peerip) > 0 || len(eio.opt_peeras) > 0 || len(eio.opt_localip) > 0
+}
+
+// checkPeer returns true iff m matches the BGP4MP peer selectors, using the
+// message tags set by the MRT reader (or present in the input)
+func (eio *Extio) checkPeer(m *msg.Msg) bool {
+	mx := pipe.MsgContext(m)
+
+	if len(eio.opt_peerip) > 0 && !MatchPrefixes(eio.opt_peerip, mx.GetTag("PEER_IP")) {
+		return false
+	}
+
+	if len(eio.opt_localip) > 0 && !MatchPrefixes(eio.opt_localip, mx.GetTag("LOCAL_IP")) {
+		return false
+	}
+
+	if len(eio.opt_peeras) > 0 {
+		asn, err := strconv.ParseUint(mx.GetTag("PEER_AS"), 10, 32)
+		if err != nil || slices.Index(eio.opt_peeras, uint32(asn)) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
 // SendMsg queues BGP message to the process. Can be used concurrently.
 func (eio *Extio) SendMsg(m *msg.Msg) bool {
 	// read-only from process?
-	if eio.opt_read {
+	if eio.opt_read || eio.Bypass.Load() {
 		return true
 	}
 
+	// select the output
+	ch := eio.Output
+	if eio.Shard != nil {
+		i := eio.Shard(m)
+		if i < 0 {
+			return true // pass through
+		}
+		ch = eio.Shards[i]
+	}
+
 	// filter the message?
 	mx := pipe.MsgContext(m)
 	if !eio.opt_copy {
@@ -415,31 +792,39 @@ func (eio *Extio) SendMsg(m *msg.Msg) bool {
 		}
 		_, err = m.WriteTo(bb)
 	case eio.opt_mrt:
-		mr := mrt.NewMrt().Use(mrt.BGP4MP_ET)
-
-		// marshal into BGP4MP
-		err = mr.Bgp4.FromMsg(m)
-		if err != nil {
-			break
-		}
-
-		// marshal into MRT
-		err = mr.Marshal()
-		if err != nil {
-			break
-		}
-
-		_, err = mr.WriteTo(bb)
+		err = eio.writeMrt(bb, m)
+	case eio.opt_pcap:
+		err = eio.writePcap(bb, m)
+	case eio.opt_proto:
+		err = eio.writeProto(bb, m)
+	case eio.opt_csv:
+		err = eio.writeCsv(bb, m)
+	case eio.opt_pq:
+		err = eio.writeParquet(bb, m)
+	case eio.opt_bgpdump:
+		err = eio.writeBgpdump(bb, m)
+	case eio.opt_pretty:
+		err = eio.writePretty(bb, m)
 	default:
 		_, err = bb.Write(m.GetJSON())
 	}
 	if err != nil {
 		eio.Warn().Err(err).Msg("extio write error")
+		eio.Pool.Put(bb)
 		return true
+	} else if bb.Len() == 0 {
+		eio.Pool.Put(bb)
+		return true // nothing to write
 	}
 
-	// try writing, don't panic on channel closed [1]
-	if !send_safe(eio.Output, bb) {
+	// try writing, respecting --overflow, don't panic on channel closed [1]
+	var ok bool
+	if eio.Router != nil {
+		ok = eio.Router(m, bb)
+	} else {
+		ok = eio.Queue(ch, bb)
+	}
+	if !ok {
 		mx.Callback.Drop()
 		return true
 	}
@@ -447,17 +832,67 @@ func (eio *Extio) SendMsg(m *msg.Msg) bool {
 	return true
 }
 
-// WriteStream rewrites eio.Output to w.
+// NewWriter returns a writer that converts eio.Output to the final output format in w.
+// If header is true, it starts with the file header required by the format, if any.
+// Close must be called at the end, but it does not close w.
+func (eio *Extio) NewWriter(w io.Writer, header bool) (io.WriteCloser, error) {
+	if eio.opt_read {
+		return nopCloser{w}, nil
+	} else if eio.opt_pq {
+		return newParquetWriter(w), nil
+	}
+
+	// needs a file header?
+	var err error
+	switch {
+	case !header:
+		break
+	case eio.opt_pcap:
+		_, err = w.Write(pcapHeader())
+	case eio.opt_csv:
+		err = csv.NewWriter(w).WriteAll([][]string{csvHeader})
+	}
+	return nopCloser{w}, err
+}
+
+// WriteStream rewrites eio.Output to w, using NewWriter.
 func (eio *Extio) WriteStream(w io.Writer) error {
-	for bb := range eio.Output {
-		_, err := bb.WriteTo(w)
-		eio.Pool.Put(bb)
-		if err != nil {
-			eio.OutputClose()
-			return err
+	err := eio.WriteStreamUntil(eio.Output, w, nil)
+	if err != nil {
+		eio.OutputClose()
+	}
+	return err
+}
+
+// WriteStreamUntil is like WriteStream, but reads from ch (eio.Output or one of eio.Shards),
+// returns early when stop is closed, and does not close ch on error, eg. to continue with another w.
+func (eio *Extio) WriteStreamUntil(ch chan *bytebufferpool.ByteBuffer, w io.Writer, stop <-chan struct{}) error {
+	ew, err := eio.NewWriter(w, true)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case bb, ok := <-ch:
+			if !ok {
+				return ew.Close()
+			}
+			_, err := bb.WriteTo(ew)
+			eio.Pool.Put(bb)
+			if err != nil {
+				ew.Close()
+				return err
+			}
+		case <-stop:
+			return ew.Close()
 		}
 	}
-	return nil
+}
+
+// InputReset discards any partial input buffered by ReadBuf, eg. when
+// the process on the other side has restarted.
+func (eio *Extio) InputReset() {
+	eio.buf.Reset()
 }
 
 // Put puts a byte buffer back to pool
@@ -472,9 +907,21 @@ func (eio *Extio) OutputClose() error {
 	eio.opt_read = true
 	eio.Callback.Drop()
 	close_safe(eio.Output)
+	for _, ch := range eio.Shards {
+		close_safe(ch)
+	}
 	return nil
 }
 
+// NewShards creates n eio.Shards, each with the same capacity as eio.Output.
+// Must be called after Attach.
+func (eio *Extio) NewShards(n int) {
+	eio.Shards = make([]chan *bytebufferpool.ByteBuffer, n)
+	for i := range eio.Shards {
+		eio.Shards[i] = make(chan *bytebufferpool.ByteBuffer, cap(eio.Output))
+	}
+}
+
 // InputClose closes all stage inputs, stopping the flow from the process to bgpipe
 func (eio *Extio) InputClose() error {
 	eio.opt_write = true
@@ -0,0 +1,159 @@
+package extio
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+// Filter selects a subset of BGP messages, eg. for a remote subscriber
+type Filter struct {
+	Dir      msg.Dir           // if non-zero, message direction
+	Types    []msg.Type        // if non-empty, message types
+	Prefixes []netip.Prefix    // if non-empty, UPDATE must have a prefix within any of these
+	Origins  []uint32          // if non-empty, UPDATE must have one of these origin ASNs
+	Tags     map[string]string // if non-empty, message must have all of these tags
+}
+
+// ParseFilter parses Filter from URL query values, eg. "dir=L&type=UPDATE&prefix=10.0.0.0/8".
+// Each key may be repeated or have comma-separated values: dir, type, prefix, origin, tag (KEY=VALUE).
+// Returns nil if no filter is set in q.
+func ParseFilter(q url.Values) (*Filter, error) {
+	f := &Filter{}
+	vals := func(key string) (ret []string) {
+		for _, v := range q[key] {
+			for _, v := range strings.Split(v, ",") {
+				if v = strings.TrimSpace(v); len(v) > 0 {
+					ret = append(ret, v)
+				}
+			}
+		}
+		return
+	}
+
+	for _, v := range vals("dir") {
+		switch strings.ToUpper(v) {
+		case "L":
+			f.Dir = msg.DIR_L
+		case "R":
+			f.Dir = msg.DIR_R
+		case "LR":
+			f.Dir = msg.DIR_LR
+		default:
+			return nil, fmt.Errorf("dir: invalid value: %s", v)
+		}
+	}
+
+	for _, v := range vals("type") {
+		typ, err := msg.TypeString(strings.ToUpper(v))
+		if err != nil {
+			tnum, err2 := strconv.Atoi(v)
+			if err2 != nil || tnum < 0 || tnum > 0xff {
+				return nil, fmt.Errorf("type: %w", err)
+			}
+			typ = msg.Type(tnum)
+		}
+		f.Types = append(f.Types, typ)
+	}
+
+	var err error
+	f.Prefixes, err = ParsePrefixes(vals("prefix"))
+	if err != nil {
+		return nil, fmt.Errorf("prefix: %w", err)
+	}
+
+	for _, v := range vals("origin") {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(v), "AS"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("origin: %w", err)
+		}
+		f.Origins = append(f.Origins, uint32(asn))
+	}
+
+	for _, v := range vals("tag") {
+		key, val, found := strings.Cut(v, "=")
+		if !found || len(key) == 0 {
+			return nil, fmt.Errorf("tag: need KEY=VALUE: %s", v)
+		}
+		if f.Tags == nil {
+			f.Tags = make(map[string]string)
+		}
+		f.Tags[key] = val
+	}
+
+	if f.Dir == 0 && len(f.Types) == 0 && len(f.Prefixes) == 0 && len(f.Origins) == 0 && len(f.Tags) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// Match returns true iff m matches the filter. A nil Filter matches all messages.
+func (f *Filter) Match(m *msg.Msg) bool {
+	switch {
+	case f == nil:
+		return true
+	case f.Dir != 0 && f.Dir != msg.DIR_LR && m.Dir != f.Dir:
+		return false
+	case len(f.Types) > 0 && slices.Index(f.Types, m.Type) < 0:
+		return false
+	}
+
+	// UPDATE contents
+	if len(f.Prefixes) > 0 || len(f.Origins) > 0 {
+		if m.Type != msg.UPDATE {
+			return false
+		}
+		u := &m.Update
+
+		if len(f.Origins) > 0 && slices.Index(f.Origins, u.Attrs.AsOrigin()) < 0 {
+			return false
+		}
+
+		if len(f.Prefixes) > 0 && !f.matchPrefixes(u) {
+			return false
+		}
+	}
+
+	// tags
+	if len(f.Tags) > 0 {
+		mx := pipe.MsgContext(m)
+		for key, val := range f.Tags {
+			if mx.GetTag(key) != val {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// matchPrefixes returns true iff any prefix in u is within f.Prefixes
+func (f *Filter) matchPrefixes(u *msg.Update) bool {
+	match := func(prefixes []netip.Prefix) bool {
+		for _, p := range prefixes {
+			for _, fp := range f.Prefixes {
+				if p.Bits() >= fp.Bits() && fp.Contains(p.Addr()) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if match(u.Reach) || match(u.Unreach) {
+		return true
+	}
+	for _, at := range []attrs.Code{attrs.ATTR_MP_REACH, attrs.ATTR_MP_UNREACH} {
+		if mp := u.Attrs.MPPrefixes(at); mp != nil && match(mp.Prefixes) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package extio
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/bgpfix/bgpfix/af"
+	"github.com/bgpfix/bgpfix/mrt"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/valyala/bytebufferpool"
+)
+
+// BGP FSM states, rfc6396/4.4.1
+const (
+	BGP_IDLE        = 1
+	BGP_CONNECT     = 2
+	BGP_ACTIVE      = 3
+	BGP_OPENSENT    = 4
+	BGP_OPENCONFIRM = 5
+	BGP_ESTABLISHED = 6
+)
+
+// bgp4mp represents the common header of MRT BGP4MP_ET messages (AS4 variants)
+type bgp4mp struct {
+	time    time.Time
+	sub     mrt.Sub
+	peerAS  uint32
+	localAS uint32
+	iface   uint16
+	peerIP  netip.Addr
+	localIP netip.Addr
+}
+
+// fromPeer fills b4 with peer metadata
+func (b4 *bgp4mp) fromPeer(peer *core.Peer) {
+	b4.peerAS = peer.RemoteASN
+	b4.localAS = peer.LocalASN
+	b4.peerIP = peer.RemoteAddr.Addr()
+	b4.localIP = peer.LocalAddr.Addr()
+}
+
+// fromTags overwrites b4 with BGP4MP metadata in m tags, if present
+func (b4 *bgp4mp) fromTags(m *msg.Msg) {
+	if !pipe.HasTags(m) {
+		return
+	}
+
+	tags := pipe.MsgTags(m)
+	if v, err := strconv.ParseUint(tags["PEER_AS"], 10, 32); err == nil {
+		b4.peerAS = uint32(v)
+	}
+	if v, err := strconv.ParseUint(tags["LOCAL_AS"], 10, 32); err == nil {
+		b4.localAS = uint32(v)
+	}
+	if v, err := netip.ParseAddr(tags["PEER_IP"]); err == nil {
+		b4.peerIP = v
+	}
+	if v, err := netip.ParseAddr(tags["LOCAL_IP"]); err == nil {
+		b4.localIP = v
+	}
+	if v, err := strconv.ParseUint(tags["INTERFACE"], 10, 16); err == nil {
+		b4.iface = uint16(v)
+	}
+}
+
+// append appends b4 to dst, followed by data, as MRT BGP4MP_ET message
+func (b4 *bgp4mp) append(dst []byte, data []byte) []byte {
+	msb := binary.BigEndian
+
+	// address family
+	var afi af.AFI
+	var peerip, localip []byte
+	if b4.peerIP.Is6() || b4.localIP.Is6() {
+		afi = af.AFI_IPV6
+		peerip, localip = make([]byte, 16), make([]byte, 16)
+		if b4.peerIP.IsValid() {
+			a := b4.peerIP.As16()
+			copy(peerip, a[:])
+		}
+		if b4.localIP.IsValid() {
+			a := b4.localIP.As16()
+			copy(localip, a[:])
+		}
+	} else {
+		afi = af.AFI_IPV4
+		peerip, localip = make([]byte, 4), make([]byte, 4)
+		copy(peerip, b4.peerIP.AsSlice())
+		copy(localip, b4.localIP.AsSlice())
+	}
+
+	// MRT header with extended timestamp
+	l := 4 + 4 + 4 + 2 + 2 + len(peerip) + len(localip) + len(data) // incl. extended timestamp
+	dst = msb.AppendUint32(dst, uint32(b4.time.Unix()))
+	dst = msb.AppendUint16(dst, uint16(mrt.BGP4MP_ET))
+	dst = msb.AppendUint16(dst, uint16(b4.sub))
+	dst = msb.AppendUint32(dst, uint32(l))
+	dst = msb.AppendUint32(dst, uint32(b4.time.Nanosecond()/1000))
+
+	// BGP4MP AS4 header
+	dst = msb.AppendUint32(dst, b4.peerAS)
+	dst = msb.AppendUint32(dst, b4.localAS)
+	dst = msb.AppendUint16(dst, b4.iface)
+	dst = msb.AppendUint16(dst, uint16(afi))
+	dst = append(dst, peerip...)
+	dst = append(dst, localip...)
+
+	// BGP4MP data
+	return append(dst, data...)
+}
+
+// msgPeer returns the BGP4MP header for m, using the metadata
+// of the connected peers or the message tags, if available.
+func (eio *Extio) msgPeer(m *msg.Msg) bgp4mp {
+	b4 := bgp4mp{
+		time: m.Time,
+		sub:  mrt.BGP4_MESSAGE_AS4,
+	}
+	if peer := eio.B.GetPeer(m.Dir); peer != nil {
+		b4.fromPeer(peer) // received from peer
+	} else if peer := eio.B.GetPeer(m.Dir.Flip()); peer != nil {
+		b4.fromPeer(peer) // sent to peer
+		b4.sub = mrt.BGP4_MESSAGE_AS4_LOCAL
+	}
+	b4.fromTags(m)
+	return b4
+}
+
+// writeMrt writes m to bb as MRT BGP4MP_ET message, using the BGP4MP metadata
+// of the connected peers or the message tags, if available.
+func (eio *Extio) writeMrt(bb *bytebufferpool.ByteBuffer, m *msg.Msg) error {
+	// make sure m is in wire format
+	if err := m.Marshal(eio.P.Caps); err != nil {
+		return err
+	}
+
+	// write raw message
+	b4 := eio.msgPeer(m)
+	data := eio.Pool.Get()
+	defer eio.Pool.Put(data)
+	if _, err := m.WriteTo(data); err != nil {
+		return err
+	}
+
+	bb.B = b4.append(bb.B, data.B)
+	return nil
+}
+
+// writeMrtState writes BGP4MP_STATE_CHANGE_AS4 for peer to eio.Output, or eio.Router if set
+func (eio *Extio) writeMrtState(peer *core.Peer, t time.Time, old_state, new_state uint16) {
+	// skip the peer?
+	if eio.Dir != msg.DIR_LR && eio.Dir != peer.Dir {
+		return
+	}
+
+	b4 := bgp4mp{
+		time: t,
+		sub:  mrt.BGP4_STATE_CHANGE_AS4,
+	}
+	b4.fromPeer(peer)
+
+	var data [4]byte
+	binary.BigEndian.PutUint16(data[0:2], old_state)
+	binary.BigEndian.PutUint16(data[2:4], new_state)
+
+	bb := eio.Pool.Get()
+	bb.B = b4.append(bb.B, data[:])
+	if eio.Router != nil {
+		eio.Router(nil, bb)
+	} else {
+		eio.Queue(eio.Output, bb)
+	}
+}
+
+// onEstablished writes MRT state changes for all connected peers
+func (eio *Extio) onEstablished(ev *pipe.Event) bool {
+	eio.established.Store(true)
+	for _, dir := range []msg.Dir{msg.DIR_L, msg.DIR_R} {
+		if peer := eio.B.GetPeer(dir); peer != nil {
+			eio.writeMrtState(peer, ev.Time, BGP_OPENCONFIRM, BGP_ESTABLISHED)
+		}
+	}
+	return true
+}
+
+// onPeerDown writes MRT state change for the disconnected peer
+func (eio *Extio) onPeerDown(ev *pipe.Event) bool {
+	vals, _ := ev.Value.([]any)
+	for _, v := range vals {
+		if peer, ok := v.(*core.Peer); ok {
+			old_state := uint16(BGP_OPENSENT)
+			if eio.established.Load() {
+				old_state = BGP_ESTABLISHED
+			}
+			eio.writeMrtState(peer, ev.Time, old_state, BGP_IDLE)
+		}
+	}
+	return true
+}
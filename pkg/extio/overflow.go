@@ -0,0 +1,107 @@
+package extio
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+// Overflow is the policy for a full Extio.Output queue
+type Overflow int
+
+const (
+	OVERFLOW_BLOCK       Overflow = iota // wait for space in the queue
+	OVERFLOW_DROP_NEWEST                 // drop the message being queued
+	OVERFLOW_DROP_OLDEST                 // drop the oldest message in the queue
+	OVERFLOW_DISCONNECT                  // wait up to a deadline, then close the output
+)
+
+// parseOverflow parses the --overflow value
+func parseOverflow(v string) (Overflow, error) {
+	switch v {
+	case "", "block":
+		return OVERFLOW_BLOCK, nil
+	case "drop-newest":
+		return OVERFLOW_DROP_NEWEST, nil
+	case "drop-oldest":
+		return OVERFLOW_DROP_OLDEST, nil
+	case "disconnect":
+		return OVERFLOW_DISCONNECT, nil
+	default:
+		return 0, fmt.Errorf("invalid value: %s (need block, drop-newest, drop-oldest, or disconnect)", v)
+	}
+}
+
+// Queue queues bb in ch (eg. eio.Output), respecting the --overflow policy.
+// For --overflow disconnect, closes ch (all output if ch is eio.Output).
+// Returns false iff ch is closed. The caller must not use bb anymore.
+func (eio *Extio) Queue(ch chan *bytebufferpool.ByteBuffer, bb *bytebufferpool.ByteBuffer) bool {
+	switch eio.opt_overflow {
+	case OVERFLOW_DROP_NEWEST:
+		sent, ok := send_wait(ch, bb, 0)
+		if !sent {
+			eio.Pool.Put(bb)
+			if ok {
+				eio.dropped(1)
+			}
+		}
+		return ok
+
+	case OVERFLOW_DROP_OLDEST:
+		for {
+			sent, ok := send_wait(ch, bb, 0)
+			if sent {
+				return true
+			} else if !ok {
+				eio.Pool.Put(bb)
+				return false
+			}
+
+			// make space
+			select {
+			case old, ok := <-ch:
+				if !ok {
+					eio.Pool.Put(bb)
+					return false
+				}
+				eio.Put(old)
+				eio.dropped(1)
+			default:
+			}
+		}
+
+	case OVERFLOW_DISCONNECT:
+		sent, ok := send_wait(ch, bb, eio.opt_ovtime)
+		if !sent {
+			eio.Pool.Put(bb)
+			if ok {
+				eio.Warn().Msgf("output queue full for %s, disconnecting", eio.opt_ovtime)
+				eio.Event("OUTPUT_DISCONNECT", len(ch))
+				if ch == eio.Output {
+					eio.OutputClose()
+				} else {
+					close_safe(ch)
+				}
+			}
+		}
+		return sent
+
+	default: // OVERFLOW_BLOCK
+		if !send_safe(ch, bb) {
+			eio.Pool.Put(bb)
+			return false
+		}
+		return true
+	}
+}
+
+// dropped counts n messages dropped due to the --overflow policy,
+// and emits the OUTPUT_DROP event at most once per second
+func (eio *Extio) dropped(n int64) {
+	total := eio.ndropped.Add(n)
+	now := time.Now().Unix()
+	if last := eio.lastdrop.Load(); last != now && eio.lastdrop.CompareAndSwap(last, now) {
+		eio.Event("OUTPUT_DROP", total)
+	}
+}
@@ -0,0 +1,727 @@
+package extio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/valyala/bytebufferpool"
+)
+
+// pcap and pcapng file format constants
+const (
+	PCAP_MAGIC_US = 0xa1b2c3d4 // classic pcap, microsecond timestamps
+	PCAP_MAGIC_NS = 0xa1b23c4d // classic pcap, nanosecond timestamps
+	PCAP_HEADLEN  = 24         // classic pcap global header length
+	PCAP_RECLEN   = 16         // classic pcap record header length
+	PCAP_SNAPLEN  = 262144     // max. packet length
+
+	PCAPNG_SHB = 0x0a0d0d0a // Section Header Block
+	PCAPNG_IDB = 1          // Interface Description Block
+	PCAPNG_SPB = 3          // Simple Packet Block
+	PCAPNG_EPB = 6          // Enhanced Packet Block
+	PCAPNG_BOM = 0x1a2b3c4d // byte-order magic
+
+	LINKTYPE_NULL      = 0
+	LINKTYPE_ETHERNET  = 1
+	LINKTYPE_RAW       = 101
+	LINKTYPE_LOOP      = 108
+	LINKTYPE_LINUX_SLL = 113
+	LINKTYPE_IPV4      = 228
+	LINKTYPE_IPV6      = 229
+	LINKTYPE_SLL2      = 276
+)
+
+// limits for TCP stream reassembly
+const (
+	pcap_MAXSEG     = 16384   // max. TCP payload in synthesized packets
+	pcap_MAXPENDING = 1024    // max. out-of-order segments per stream
+	pcap_MAXBUF     = 1 << 20 // max. buffered stream data without a valid BGP message
+)
+
+// default endpoints of synthesized packets, if the peers are not known
+var (
+	pcap_L = netip.MustParseAddrPort("192.0.2.1:49152")
+	pcap_R = netip.MustParseAddrPort("192.0.2.2:179")
+)
+
+var bgp_marker = bytes.Repeat([]byte{0xff}, 16)
+
+// pcapWriter synthesizes TCP/IP packets carrying BGP messages
+type pcapWriter struct {
+	sync.Mutex
+	seq  [3]uint32 // next TCP sequence number, indexed by msg.Dir
+	ipid uint16    // next IPv4 identification
+}
+
+// pcapHeader returns the classic pcap global header for LINKTYPE_RAW
+func pcapHeader() []byte {
+	lsb := binary.LittleEndian
+	buf := make([]byte, 0, PCAP_HEADLEN)
+	buf = lsb.AppendUint32(buf, PCAP_MAGIC_US)
+	buf = lsb.AppendUint16(buf, 2) // major version
+	buf = lsb.AppendUint16(buf, 4) // minor version
+	buf = lsb.AppendUint32(buf, 0) // thiszone
+	buf = lsb.AppendUint32(buf, 0) // sigfigs
+	buf = lsb.AppendUint32(buf, PCAP_SNAPLEN)
+	buf = lsb.AppendUint32(buf, LINKTYPE_RAW)
+	return buf
+}
+
+// pcapEndpoints returns the TCP endpoints for a message sent in direction dir
+func (eio *Extio) pcapEndpoints(dir msg.Dir) (src, dst netip.AddrPort) {
+	if peer := eio.B.GetPeer(dir); peer != nil && peer.RemoteAddr.IsValid() && peer.LocalAddr.IsValid() {
+		return peer.RemoteAddr, peer.LocalAddr // received from peer
+	} else if peer := eio.B.GetPeer(dir.Flip()); peer != nil && peer.RemoteAddr.IsValid() && peer.LocalAddr.IsValid() {
+		return peer.LocalAddr, peer.RemoteAddr // sent to peer
+	} else if dir == msg.DIR_L {
+		return pcap_R, pcap_L
+	} else {
+		return pcap_L, pcap_R
+	}
+}
+
+// writePcap writes m to bb as pcap record(s) of synthesized TCP/IP packet(s)
+func (eio *Extio) writePcap(bb *bytebufferpool.ByteBuffer, m *msg.Msg) error {
+	// make sure m is in wire format
+	if err := m.Marshal(eio.P.Caps); err != nil {
+		return err
+	}
+	data := eio.Pool.Get()
+	defer eio.Pool.Put(data)
+	if _, err := m.WriteTo(data); err != nil {
+		return err
+	}
+
+	// where does it go?
+	dir := m.Dir
+	if dir != msg.DIR_L {
+		dir = msg.DIR_R
+	}
+	src, dst := eio.pcapEndpoints(dir)
+	if src.Addr().Is4() != dst.Addr().Is4() {
+		src, dst = pcap_L, pcap_R // should not happen
+	}
+
+	// take the TCP sequence numbers
+	pw := &eio.pcapw
+	pw.Lock()
+	seq, ack := pw.seq[dir], pw.seq[dir.Flip()]
+	pw.seq[dir] += uint32(len(data.B))
+	ipid := pw.ipid
+	pw.ipid += uint16(len(data.B)/pcap_MAXSEG + 1)
+	pw.Unlock()
+
+	// write in segments
+	raw := data.B
+	for len(raw) > 0 {
+		seg := raw[:min(len(raw), pcap_MAXSEG)]
+		raw = raw[len(seg):]
+		bb.B = appendPcapPacket(bb.B, m.Time, src, dst, seq, ack, ipid, seg)
+		seq += uint32(len(seg))
+		ipid++
+	}
+
+	return nil
+}
+
+// appendPcapPacket appends a pcap record with a TCP/IP packet carrying payload to dst
+func appendPcapPacket(dst []byte, t time.Time, src, dstap netip.AddrPort, seq, ack uint32, ipid uint16, payload []byte) []byte {
+	msb := binary.BigEndian
+	lsb := binary.LittleEndian
+
+	var iplen int
+	if src.Addr().Is4() {
+		iplen = 20
+	} else {
+		iplen = 40
+	}
+	plen := iplen + 20 + len(payload)
+
+	// record header
+	if t.IsZero() {
+		t = time.Now()
+	}
+	dst = lsb.AppendUint32(dst, uint32(t.Unix()))
+	dst = lsb.AppendUint32(dst, uint32(t.Nanosecond()/1000))
+	dst = lsb.AppendUint32(dst, uint32(plen))
+	dst = lsb.AppendUint32(dst, uint32(plen))
+
+	// IP header
+	ip := len(dst)
+	sa, da := src.Addr().AsSlice(), dstap.Addr().AsSlice()
+	if iplen == 20 {
+		dst = append(dst, 0x45, 0)
+		dst = msb.AppendUint16(dst, uint16(plen))
+		dst = msb.AppendUint16(dst, ipid)
+		dst = msb.AppendUint16(dst, 0x4000) // DF
+		dst = append(dst, 64, 6, 0, 0)      // TTL, TCP, checksum
+		dst = append(dst, sa...)
+		dst = append(dst, da...)
+		msb.PutUint16(dst[ip+10:], inetChecksum(dst[ip:ip+20], 0))
+	} else {
+		dst = msb.AppendUint32(dst, 0x60000000)
+		dst = msb.AppendUint16(dst, uint16(20+len(payload)))
+		dst = append(dst, 6, 64) // TCP, hop limit
+		dst = append(dst, sa...)
+		dst = append(dst, da...)
+	}
+
+	// TCP header
+	tcp := len(dst)
+	dst = msb.AppendUint16(dst, src.Port())
+	dst = msb.AppendUint16(dst, dstap.Port())
+	dst = msb.AppendUint32(dst, seq)
+	dst = msb.AppendUint32(dst, ack)
+	dst = append(dst, 5<<4, 0x18)      // data offset, PSH+ACK
+	dst = msb.AppendUint16(dst, 65535) // window
+	dst = append(dst, 0, 0, 0, 0)      // checksum, urgent pointer
+	dst = append(dst, payload...)
+
+	// TCP checksum, including the pseudo-header
+	var sum uint32
+	for _, b := range [][]byte{sa, da} {
+		for i := 0; i < len(b); i += 2 {
+			sum += uint32(msb.Uint16(b[i:]))
+		}
+	}
+	sum += 6 + uint32(len(dst)-tcp)
+	msb.PutUint16(dst[tcp+16:], inetChecksum(dst[tcp:], sum))
+
+	return dst
+}
+
+// inetChecksum returns the Internet checksum of buf, starting with sum
+func inetChecksum(buf []byte, sum uint32) uint16 {
+	for len(buf) >= 2 {
+		sum += uint32(buf[0])<<8 | uint32(buf[1])
+		buf = buf[2:]
+	}
+	if len(buf) > 0 {
+		sum += uint32(buf[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// pcapReader reassembles TCP streams from pcap or pcapng data,
+// and extracts BGP messages for each direction
+type pcapReader struct {
+	eio  *Extio
+	ibuf []byte // input buffer
+
+	started bool             // seen the file header?
+	ng      bool             // pcapng format?
+	order   binary.ByteOrder // file byte order
+	tsunit  time.Duration    // classic pcap timestamp unit
+	link    uint32           // classic pcap link type
+	ifaces  []pcapIface      // pcapng interfaces
+
+	streams map[pcapFlow]*pcapStream // TCP streams
+}
+
+// pcapIface describes a pcapng interface
+type pcapIface struct {
+	link  uint32 // link type
+	tsres uint64 // timestamp units per second
+}
+
+// pcapFlow identifies a TCP stream in one direction
+type pcapFlow struct {
+	src, dst netip.AddrPort
+}
+
+// pcapStream represents a reassembled TCP stream
+type pcapStream struct {
+	dir     msg.Dir           // BGP message direction
+	next    uint32            // next expected TCP sequence number
+	synced  bool              // buf starts at a BGP message boundary?
+	buf     []byte            // reassembled data waiting for parsing
+	pending map[uint32][]byte // out-of-order segments
+}
+
+func newPcapReader(eio *Extio) *pcapReader {
+	return &pcapReader{
+		eio:     eio,
+		streams: make(map[pcapFlow]*pcapStream),
+	}
+}
+
+// WriteFunc reads all complete pcap records in src, buffering the rest,
+// and writes the BGP messages found in TCP streams to the Extio inputs.
+// cb is called just before the message is accepted for processing; if it
+// returns false, the message is silently dropped instead.
+// Must not be used concurrently.
+func (pr *pcapReader) WriteFunc(src []byte, cb pipe.CallbackFunc) (n int, err error) {
+	n = len(src)
+	pr.ibuf = append(pr.ibuf, src...)
+	raw := pr.ibuf
+
+	// leave the remainder at start of pr.ibuf on return
+	defer func() {
+		pr.ibuf = append(pr.ibuf[:0], raw...)
+	}()
+
+	for len(raw) > 0 {
+		var off int
+		var err error
+		if !pr.started {
+			off, err = pr.readHeader(raw)
+		} else if pr.ng {
+			off, err = pr.readBlock(raw, cb)
+		} else {
+			off, err = pr.readRecord(raw, cb)
+		}
+
+		switch err {
+		case nil:
+			raw = raw[off:]
+		case io.ErrUnexpectedEOF:
+			return n, nil // need more data
+		default:
+			raw = nil // no idea, throw out
+			return n, fmt.Errorf("pcap: %w", err)
+		}
+	}
+
+	return n, nil
+}
+
+// readHeader reads the file header in raw
+func (pr *pcapReader) readHeader(raw []byte) (off int, err error) {
+	if len(raw) < 12 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	// pcapng?
+	if binary.LittleEndian.Uint32(raw) == PCAPNG_SHB {
+		pr.ng = true
+		pr.started = true
+		return 0, nil // will be read by readBlock()
+	}
+
+	// classic pcap, which byte order?
+	if len(raw) < PCAP_HEADLEN {
+		return 0, io.ErrUnexpectedEOF
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(raw) {
+		case PCAP_MAGIC_US:
+			pr.tsunit = time.Microsecond
+		case PCAP_MAGIC_NS:
+			pr.tsunit = time.Nanosecond
+		default:
+			continue
+		}
+		pr.order = order
+		pr.link = order.Uint32(raw[20:24]) & 0xffff
+		pr.started = true
+		return PCAP_HEADLEN, nil
+	}
+
+	return 0, ErrFormat
+}
+
+// readRecord reads a classic pcap record in raw
+func (pr *pcapReader) readRecord(raw []byte, cb pipe.CallbackFunc) (off int, err error) {
+	if len(raw) < PCAP_RECLEN {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	o := pr.order
+	sec, frac := o.Uint32(raw[0:4]), o.Uint32(raw[4:8])
+	l := int(o.Uint32(raw[8:12]))
+	if l > PCAP_SNAPLEN {
+		return 0, ErrLength
+	} else if len(raw) < PCAP_RECLEN+l {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	t := time.Unix(int64(sec), int64(frac)*int64(pr.tsunit)).UTC()
+	return PCAP_RECLEN + l, pr.readPacket(pr.link, t, raw[PCAP_RECLEN:PCAP_RECLEN+l], cb)
+}
+
+// readBlock reads a pcapng block in raw
+func (pr *pcapReader) readBlock(raw []byte, cb pipe.CallbackFunc) (off int, err error) {
+	if len(raw) < 12 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	// new section? check the byte order first
+	btype := binary.LittleEndian.Uint32(raw[0:4])
+	if btype == PCAPNG_SHB {
+		switch uint32(PCAPNG_BOM) {
+		case binary.LittleEndian.Uint32(raw[8:12]):
+			pr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(raw[8:12]):
+			pr.order = binary.BigEndian
+		default:
+			return 0, ErrFormat
+		}
+		pr.ifaces = pr.ifaces[:0]
+	} else if pr.order == nil {
+		return 0, ErrFormat
+	}
+
+	// block length
+	o := pr.order
+	btype = o.Uint32(raw[0:4])
+	l := int(o.Uint32(raw[4:8]))
+	if l < 12 || l%4 != 0 {
+		return 0, ErrLength
+	} else if len(raw) < l {
+		return 0, io.ErrUnexpectedEOF
+	}
+	body := raw[8 : l-4]
+
+	switch btype {
+	case PCAPNG_IDB:
+		if len(body) < 8 {
+			return 0, ErrLength
+		}
+		iface := pcapIface{
+			link:  uint32(o.Uint16(body[0:2])),
+			tsres: 1e6,
+		}
+
+		// look for if_tsresol
+		opts := body[8:]
+		for len(opts) >= 4 {
+			code, olen := o.Uint16(opts[0:2]), int(o.Uint16(opts[2:4]))
+			opts = opts[4:]
+			if code == 0 || olen > len(opts) {
+				break
+			} else if code == 9 && olen >= 1 {
+				if v := opts[0]; v&0x80 != 0 {
+					if v &= 0x7f; v < 64 {
+						iface.tsres = 1 << v
+					}
+				} else if v < 20 { // NB: 10^19 still fits in uint64
+					for iface.tsres = 1; v > 0; v-- {
+						iface.tsres *= 10
+					}
+				}
+			}
+			opts = opts[min(len(opts), (olen+3)&^3):]
+		}
+
+		pr.ifaces = append(pr.ifaces, iface)
+
+	case PCAPNG_EPB:
+		if len(body) < 20 {
+			return 0, ErrLength
+		}
+		id := int(o.Uint32(body[0:4]))
+		if id >= len(pr.ifaces) {
+			return 0, fmt.Errorf("invalid interface id %d", id)
+		}
+		iface := pr.ifaces[id]
+
+		ts := uint64(o.Uint32(body[4:8]))<<32 | uint64(o.Uint32(body[8:12]))
+		caplen := int(o.Uint32(body[12:16]))
+		if caplen > len(body)-20 {
+			return 0, ErrLength
+		}
+
+		// NB: rem*1e9 may overflow, so use 128-bit math
+		sec, rem := ts/iface.tsres, ts%iface.tsres
+		hi, lo := bits.Mul64(rem, 1e9)
+		nsec, _ := bits.Div64(hi, lo, iface.tsres)
+		t := time.Unix(int64(sec), int64(nsec)).UTC()
+		err = pr.readPacket(iface.link, t, body[20:20+caplen], cb)
+
+	case PCAPNG_SPB:
+		if len(body) < 4 || len(pr.ifaces) == 0 {
+			return 0, ErrLength
+		}
+		caplen := min(int(o.Uint32(body[0:4])), len(body)-4)
+		err = pr.readPacket(pr.ifaces[0].link, time.Time{}, body[4:4+caplen], cb)
+	}
+
+	return l, err
+}
+
+// readPacket reads a captured packet of given link type, and feeds its TCP payload
+// to the relevant stream. Skips non-TCP packets.
+func (pr *pcapReader) readPacket(link uint32, t time.Time, pkt []byte, cb pipe.CallbackFunc) error {
+	msb := binary.BigEndian
+
+	// strip the link layer
+	var ethertype uint16
+	switch link {
+	case LINKTYPE_ETHERNET:
+		if len(pkt) < 14 {
+			return nil
+		}
+		ethertype, pkt = msb.Uint16(pkt[12:14]), pkt[14:]
+		for (ethertype == 0x8100 || ethertype == 0x88a8) && len(pkt) >= 4 {
+			ethertype, pkt = msb.Uint16(pkt[2:4]), pkt[4:] // VLAN
+		}
+	case LINKTYPE_NULL, LINKTYPE_LOOP:
+		if len(pkt) < 4 {
+			return nil
+		}
+		pkt = pkt[4:]
+	case LINKTYPE_LINUX_SLL:
+		if len(pkt) < 16 {
+			return nil
+		}
+		ethertype, pkt = msb.Uint16(pkt[14:16]), pkt[16:]
+	case LINKTYPE_SLL2:
+		if len(pkt) < 20 {
+			return nil
+		}
+		ethertype, pkt = msb.Uint16(pkt[0:2]), pkt[20:]
+	case LINKTYPE_RAW, LINKTYPE_IPV4, LINKTYPE_IPV6:
+		// no link layer
+	default:
+		return fmt.Errorf("unsupported link type %d", link)
+	}
+	if ethertype != 0 && ethertype != 0x0800 && ethertype != 0x86dd {
+		return nil // not IP
+	}
+
+	// parse the IP header
+	var src, dst netip.Addr
+	if len(pkt) < 20 {
+		return nil
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		tlen := int(msb.Uint16(pkt[2:4]))
+		if pkt[9] != 6 || ihl < 20 || tlen < ihl || tlen > len(pkt) {
+			return nil // not TCP, or truncated
+		} else if msb.Uint16(pkt[6:8])&0x3fff != 0 {
+			return nil // fragmented
+		}
+		src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+		pkt = pkt[ihl:tlen]
+	case 6:
+		if len(pkt) < 40 {
+			return nil
+		}
+		next := pkt[6]
+		plen := int(msb.Uint16(pkt[4:6]))
+		src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+		pkt = pkt[40:min(len(pkt), 40+plen)]
+
+		// skip the extension headers
+		for next == 0 || next == 43 || next == 60 {
+			if len(pkt) < 8 {
+				return nil
+			}
+			elen := (int(pkt[1]) + 1) * 8
+			if elen > len(pkt) {
+				return nil
+			}
+			next, pkt = pkt[0], pkt[elen:]
+		}
+		if next != 6 {
+			return nil // not TCP
+		}
+	default:
+		return nil
+	}
+
+	// parse the TCP header
+	if len(pkt) < 20 {
+		return nil
+	}
+	doff := int(pkt[12]>>4) * 4
+	if doff < 20 || doff > len(pkt) {
+		return nil
+	}
+	flow := pcapFlow{
+		src: netip.AddrPortFrom(src, msb.Uint16(pkt[0:2])),
+		dst: netip.AddrPortFrom(dst, msb.Uint16(pkt[2:4])),
+	}
+	seq := msb.Uint32(pkt[4:8])
+	flags := pkt[13]
+	payload := pkt[doff:]
+
+	// find the stream
+	ps := pr.streams[flow]
+	if ps == nil {
+		ps = pr.newStream(flow, flags)
+		if flags&0x02 != 0 { // SYN
+			ps.next = seq + 1
+			ps.synced = true
+		} else {
+			ps.next = seq
+		}
+	}
+
+	// RST? forget the stream
+	if flags&0x04 != 0 {
+		delete(pr.streams, flow)
+		return nil
+	}
+
+	// reassemble and parse
+	if ps.add(seq, payload) {
+		return pr.parseStream(flow, ps, t, cb)
+	}
+	return nil
+}
+
+// newStream creates a new TCP stream for flow, guessing its direction
+func (pr *pcapReader) newStream(flow pcapFlow, flags byte) *pcapStream {
+	ps := &pcapStream{
+		pending: make(map[uint32][]byte),
+	}
+
+	// the TCP client is the L peer, which sends messages in the R direction
+	rev := pr.streams[pcapFlow{flow.dst, flow.src}]
+	switch {
+	case rev != nil:
+		ps.dir = rev.dir.Flip()
+	case flow.dst.Port() == 179 && flow.src.Port() != 179:
+		ps.dir = msg.DIR_R
+	case flow.src.Port() == 179 && flow.dst.Port() != 179:
+		ps.dir = msg.DIR_L
+	case flags&0x12 == 0x12: // SYN+ACK
+		ps.dir = msg.DIR_L
+	default:
+		ps.dir = msg.DIR_R
+	}
+
+	pr.streams[flow] = ps
+	return ps
+}
+
+// add adds TCP segment at seq to ps, returning true iff ps.buf got new data
+func (ps *pcapStream) add(seq uint32, data []byte) (added bool) {
+	if len(data) == 0 {
+		return false
+	}
+
+	// retransmission or out-of-order?
+	if diff := int32(seq - ps.next); diff < 0 {
+		if int(-diff) >= len(data) {
+			return false // already seen
+		}
+		data = data[-diff:]
+	} else if diff > 0 {
+		ps.pending[seq] = bytes.Clone(data)
+		if len(ps.pending) <= pcap_MAXPENDING {
+			return false // wait for the missing data
+		}
+
+		// lost data? skip the gap, start from the first pending segment
+		for s := range ps.pending {
+			if int32(s-seq) < 0 {
+				seq = s
+			}
+		}
+		data = ps.pending[seq]
+		delete(ps.pending, seq)
+		ps.next = seq
+		ps.synced = false
+		ps.buf = ps.buf[:0]
+	}
+
+	// append in-order data, including pending segments
+	for {
+		ps.buf = append(ps.buf, data...)
+		ps.next += uint32(len(data))
+
+		data = nil
+		for s, v := range ps.pending {
+			if diff := int32(s - ps.next); diff <= 0 {
+				delete(ps.pending, s)
+				if int(-diff) < len(v) {
+					data = v[-diff:]
+					break
+				}
+			}
+		}
+		if data == nil {
+			return true
+		}
+	}
+}
+
+// parseStream extracts complete BGP messages from ps.buf
+func (pr *pcapReader) parseStream(flow pcapFlow, ps *pcapStream, t time.Time, cb pipe.CallbackFunc) error {
+	var (
+		eio = pr.eio
+		p   = eio.P
+		buf = ps.buf
+	)
+
+	// move the remainder to the start of ps.buf on return
+	defer func() {
+		if len(buf) > pcap_MAXBUF {
+			buf = nil // garbage
+		}
+		ps.buf = append(ps.buf[:0], buf...)
+	}()
+
+	for len(buf) > 0 {
+		// look for the BGP marker iff needed
+		if !ps.synced {
+			i := bytes.Index(buf, bgp_marker)
+			if i < 0 {
+				buf = buf[max(0, len(buf)-len(bgp_marker)+1):]
+				return nil // need more data
+			}
+			buf = buf[i:]
+			ps.synced = true
+		}
+
+		// parse as raw BGP message
+		m := p.GetMsg()
+		off, err := m.FromBytes(buf)
+		switch err {
+		case nil:
+			buf = buf[off:]
+		case io.ErrUnexpectedEOF:
+			p.PutMsg(m)
+			return nil // need more data
+		default:
+			p.PutMsg(m)
+			ps.synced = false // try to re-sync
+			buf = buf[1:]
+			continue
+		}
+
+		// fill the metadata
+		m.Dir = ps.dir
+		m.Time = t
+		tags := pipe.MsgTags(m)
+		tags["PEER_IP"] = flow.src.Addr().String()
+		tags["LOCAL_IP"] = flow.dst.Addr().String()
+
+		// take it?
+		if cb != nil && !cb(m) {
+			p.PutMsg(m)
+			continue
+		}
+
+		// sail!
+		m.CopyData()
+		var err2 error
+		if ps.dir == msg.DIR_L {
+			err2 = eio.InputL.WriteMsg(m)
+		} else {
+			err2 = eio.InputR.WriteMsg(m)
+		}
+		if err2 != nil {
+			return fmt.Errorf("pipe: %w", err2)
+		}
+	}
+
+	return nil
+}
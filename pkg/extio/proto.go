@@ -0,0 +1,535 @@
+package extio
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"github.com/bgpfix/bgpfix/af"
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/caps"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/valyala/bytebufferpool"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf field numbers, see bgpipe.proto
+const (
+	pb_MSG_DIR    = 1
+	pb_MSG_SEQ    = 2
+	pb_MSG_TIME   = 3
+	pb_MSG_TYPE   = 4
+	pb_MSG_DATA   = 5
+	pb_MSG_UPDATE = 6
+	pb_MSG_TAGS   = 7
+
+	pb_UPD_UNREACH     = 1
+	pb_UPD_REACH       = 2
+	pb_UPD_NEXTHOP     = 3
+	pb_UPD_NEXTHOP_LL  = 4
+	pb_UPD_ORIGIN      = 5
+	pb_UPD_ASPATH      = 6
+	pb_UPD_MED         = 7
+	pb_UPD_LOCALPREF   = 8
+	pb_UPD_COMMUNITIES = 9
+	pb_UPD_LARGECOM    = 10
+	pb_UPD_ATTRS       = 11
+)
+
+// proto_MAXLEN is the max. length of a Protobuf message on input
+const proto_MAXLEN = 1 << 20
+
+// writeProto writes m to bb as a length-delimited Protobuf Msg
+func (eio *Extio) writeProto(bb *bytebufferpool.ByteBuffer, m *msg.Msg) error {
+	body := eio.Pool.Get()
+	defer eio.Pool.Put(body)
+
+	// header
+	b := body.B[:0]
+	if m.Dir != 0 {
+		b = protowire.AppendTag(b, pb_MSG_DIR, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Dir))
+	}
+	if m.Seq != 0 {
+		b = protowire.AppendTag(b, pb_MSG_SEQ, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Seq))
+	}
+	if !m.Time.IsZero() {
+		b = protowire.AppendTag(b, pb_MSG_TIME, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Time.UnixNano()))
+	}
+	b = protowire.AppendTag(b, pb_MSG_TYPE, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Type))
+
+	// parsed UPDATE or raw data
+	if m.Type == msg.UPDATE && m.Parse(eio.P.Caps) == nil {
+		upd := eio.Pool.Get()
+		upd.B = appendProtoUpdate(upd.B, &m.Update, eio.P.Caps)
+		b = protowire.AppendTag(b, pb_MSG_UPDATE, protowire.BytesType)
+		b = protowire.AppendBytes(b, upd.B)
+		eio.Pool.Put(upd)
+	} else if err := m.Marshal(eio.P.Caps); err != nil {
+		return err
+	} else {
+		b = protowire.AppendTag(b, pb_MSG_DATA, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Data)
+	}
+
+	// tags
+	if pipe.HasTags(m) {
+		for k, v := range pipe.MsgTags(m) {
+			b = protowire.AppendTag(b, pb_MSG_TAGS, protowire.BytesType)
+			b = protowire.AppendVarint(b, uint64(
+				protowire.SizeTag(1)+protowire.SizeBytes(len(k))+
+					protowire.SizeTag(2)+protowire.SizeBytes(len(v))))
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendString(b, k)
+			b = protowire.AppendTag(b, 2, protowire.BytesType)
+			b = protowire.AppendString(b, v)
+		}
+	}
+
+	// write with length
+	body.B = b
+	bb.B = protowire.AppendVarint(bb.B, uint64(len(b)))
+	bb.B = append(bb.B, b...)
+	return nil
+}
+
+// appendProtoUpdate appends u to dst as Protobuf Update
+func appendProtoUpdate(dst []byte, u *msg.Update, cps caps.Caps) []byte {
+	ats := &u.Attrs
+	mp_reach := ats.MPPrefixes(attrs.ATTR_MP_REACH)
+	mp_unreach := ats.MPPrefixes(attrs.ATTR_MP_UNREACH)
+
+	prefixes := func(num protowire.Number, prefixes []netip.Prefix) {
+		for _, p := range prefixes {
+			dst = protowire.AppendTag(dst, num, protowire.BytesType)
+			dst = protowire.AppendString(dst, p.String())
+		}
+	}
+	addr := func(num protowire.Number, addr netip.Addr) {
+		if addr.IsValid() {
+			dst = protowire.AppendTag(dst, num, protowire.BytesType)
+			dst = protowire.AppendString(dst, addr.String())
+		}
+	}
+	u32 := func(num protowire.Number, val uint32) {
+		dst = protowire.AppendTag(dst, num, protowire.VarintType)
+		dst = protowire.AppendVarint(dst, uint64(val))
+	}
+
+	// prefixes and next hop
+	prefixes(pb_UPD_UNREACH, u.Unreach)
+	if mp_unreach != nil {
+		prefixes(pb_UPD_UNREACH, mp_unreach.Prefixes)
+	}
+	prefixes(pb_UPD_REACH, u.Reach)
+	nexthop := false // NEXTHOP encoded?
+	if mp_reach != nil {
+		prefixes(pb_UPD_REACH, mp_reach.Prefixes)
+		addr(pb_UPD_NEXTHOP, mp_reach.NextHop)
+		addr(pb_UPD_NEXTHOP_LL, mp_reach.LinkLocal)
+	} else if a, ok := ats.Get(attrs.ATTR_NEXTHOP).(*attrs.IP); ok {
+		addr(pb_UPD_NEXTHOP, a.Addr)
+		nexthop = true
+	}
+
+	// path attributes (NB: empty AS_PATH and COMMUNITY go in wire format)
+	if a, ok := ats.Get(attrs.ATTR_ORIGIN).(*attrs.Origin); ok {
+		u32(pb_UPD_ORIGIN, uint32(a.Origin))
+	}
+	aspath := false
+	if a := ats.AsPath(); a != nil && len(a.Segments) > 0 {
+		aspath = true
+		for _, seg := range a.Segments {
+			var sb []byte
+			if seg.IsSet {
+				sb = protowire.AppendTag(sb, 1, protowire.VarintType)
+				sb = protowire.AppendVarint(sb, 1)
+			}
+			sb = appendPacked(sb, 2, seg.List)
+			dst = protowire.AppendTag(dst, pb_UPD_ASPATH, protowire.BytesType)
+			dst = protowire.AppendBytes(dst, sb)
+		}
+	}
+	if a, ok := ats.Get(attrs.ATTR_MED).(*attrs.U32); ok {
+		u32(pb_UPD_MED, a.Val)
+	}
+	if a, ok := ats.Get(attrs.ATTR_LOCALPREF).(*attrs.U32); ok {
+		u32(pb_UPD_LOCALPREF, a.Val)
+	}
+	community := false
+	if a, ok := ats.Get(attrs.ATTR_COMMUNITY).(*attrs.Community); ok && len(a.ASN) > 0 {
+		community = true
+		coms := make([]uint32, len(a.ASN))
+		for i := range a.ASN {
+			coms[i] = uint32(a.ASN[i])<<16 | uint32(a.Value[i])
+		}
+		dst = appendPacked(dst, pb_UPD_COMMUNITIES, coms)
+	}
+	largecom := false
+	if a, ok := ats.Get(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom); ok && len(a.ASN) > 0 {
+		largecom = true
+		for i := range a.ASN {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.VarintType)
+			lb = protowire.AppendVarint(lb, uint64(a.ASN[i]))
+			lb = protowire.AppendTag(lb, 2, protowire.VarintType)
+			lb = protowire.AppendVarint(lb, uint64(a.Value1[i]))
+			lb = protowire.AppendTag(lb, 3, protowire.VarintType)
+			lb = protowire.AppendVarint(lb, uint64(a.Value2[i]))
+			dst = protowire.AppendTag(dst, pb_UPD_LARGECOM, protowire.BytesType)
+			dst = protowire.AppendBytes(dst, lb)
+		}
+	}
+
+	// other attributes in wire format
+	var raw []byte
+	ats.Each(func(i int, ac attrs.Code, at attrs.Attr) {
+		switch ac {
+		case attrs.ATTR_ORIGIN, attrs.ATTR_MED, attrs.ATTR_LOCALPREF:
+			return // already done
+		case attrs.ATTR_ASPATH:
+			if aspath {
+				return
+			}
+		case attrs.ATTR_COMMUNITY:
+			if community {
+				return
+			}
+		case attrs.ATTR_LARGE_COMMUNITY:
+			if largecom {
+				return
+			}
+		case attrs.ATTR_NEXTHOP:
+			if nexthop {
+				return
+			}
+		case attrs.ATTR_MP_REACH:
+			if mp_reach != nil {
+				return
+			}
+		case attrs.ATTR_MP_UNREACH:
+			if mp_unreach != nil {
+				return
+			}
+		}
+		raw = at.Marshal(raw, cps)
+	})
+	if len(raw) > 0 {
+		dst = protowire.AppendTag(dst, pb_UPD_ATTRS, protowire.BytesType)
+		dst = protowire.AppendBytes(dst, raw)
+	}
+
+	return dst
+}
+
+// appendPacked appends vals to dst as a packed repeated uint32 field
+func appendPacked(dst []byte, num protowire.Number, vals []uint32) []byte {
+	if len(vals) == 0 {
+		return dst
+	}
+
+	var l int
+	for _, v := range vals {
+		l += protowire.SizeVarint(uint64(v))
+	}
+	dst = protowire.AppendTag(dst, num, protowire.BytesType)
+	dst = protowire.AppendVarint(dst, uint64(l))
+	for _, v := range vals {
+		dst = protowire.AppendVarint(dst, uint64(v))
+	}
+	return dst
+}
+
+// protoNext returns the length of the next length-delimited Protobuf message
+// in buf, including its length prefix, or 0 if buf needs more data.
+func protoNext(buf []byte) (int, error) {
+	l, n := protowire.ConsumeVarint(buf)
+	switch {
+	case n < 0 && len(buf) < binary.MaxVarintLen64:
+		return 0, nil // need more data
+	case n < 0 || l > proto_MAXLEN:
+		return 0, ErrFormat
+	case len(buf) < n+int(l):
+		return 0, nil // need more data
+	default:
+		return n + int(l), nil
+	}
+}
+
+// readProto reads length-delimited Protobuf Msg from buf into m
+func (eio *Extio) readProto(buf []byte, m *msg.Msg) error {
+	l, n := protowire.ConsumeVarint(buf)
+	if n < 0 {
+		return ErrFormat
+	} else if n+int(l) != len(buf) {
+		return ErrLength
+	}
+	buf = buf[n:]
+
+	var (
+		typ  msg.Type
+		data []byte
+		upd  []byte
+	)
+	err := protoEach(buf, func(num protowire.Number, v uint64, b []byte) error {
+		switch num {
+		case pb_MSG_DIR:
+			m.Dir = msg.Dir(v)
+		case pb_MSG_SEQ:
+			m.Seq = int64(v)
+		case pb_MSG_TIME:
+			m.Time = time.Unix(0, int64(v)).UTC()
+		case pb_MSG_TYPE:
+			typ = msg.Type(v)
+		case pb_MSG_DATA:
+			data = b
+		case pb_MSG_UPDATE:
+			upd = b
+		case pb_MSG_TAGS:
+			var key, val string
+			err := protoEach(b, func(num protowire.Number, _ uint64, b []byte) error {
+				switch num {
+				case 1:
+					key = string(b)
+				case 2:
+					val = string(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			pipe.MsgTags(m)[key] = val
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// raw data takes priority
+	switch {
+	case data != nil || (upd == nil && typ != msg.UPDATE):
+		if typ == msg.INVALID {
+			return ErrFormat
+		}
+		return fromData(m, typ, data)
+	case typ != msg.UPDATE && typ != msg.INVALID:
+		return ErrFormat
+	default:
+		return readProtoUpdate(upd, m.Use(msg.UPDATE), eio.P.Caps)
+	}
+}
+
+// readProtoUpdate reads Protobuf Update from buf into m
+func readProtoUpdate(buf []byte, m *msg.Msg, cps caps.Caps) error {
+	u := &m.Update
+	var (
+		unreach, reach      []netip.Prefix
+		nexthop, nexthop_ll netip.Addr
+		origin              = -1
+		aspath              []attrs.AspathSegment
+		med, localpref      = -1, -1
+		coms                []uint32
+		large               [][3]uint32
+	)
+	err := protoEach(buf, func(num protowire.Number, v uint64, b []byte) (err error) {
+		switch num {
+		case pb_UPD_UNREACH, pb_UPD_REACH:
+			p, err := netip.ParsePrefix(string(b))
+			if err != nil {
+				return err
+			} else if num == pb_UPD_UNREACH {
+				unreach = append(unreach, p)
+			} else {
+				reach = append(reach, p)
+			}
+		case pb_UPD_NEXTHOP:
+			nexthop, err = netip.ParseAddr(string(b))
+		case pb_UPD_NEXTHOP_LL:
+			nexthop_ll, err = netip.ParseAddr(string(b))
+		case pb_UPD_ORIGIN:
+			origin = int(v)
+		case pb_UPD_ASPATH:
+			var seg attrs.AspathSegment
+			err = protoEach(b, func(num protowire.Number, v uint64, b []byte) (err error) {
+				switch num {
+				case 1:
+					seg.IsSet = v != 0
+				case 2:
+					seg.List, err = protoPacked(seg.List, v, b)
+				}
+				return
+			})
+			aspath = append(aspath, seg)
+		case pb_UPD_MED:
+			med = int(v)
+		case pb_UPD_LOCALPREF:
+			localpref = int(v)
+		case pb_UPD_COMMUNITIES:
+			coms, err = protoPacked(coms, v, b)
+		case pb_UPD_LARGECOM:
+			var lc [3]uint32
+			err = protoEach(b, func(num protowire.Number, v uint64, b []byte) error {
+				if num >= 1 && num <= 3 {
+					lc[num-1] = uint32(v)
+				}
+				return nil
+			})
+			large = append(large, lc)
+		case pb_UPD_ATTRS:
+			u.RawAttrs = b
+			err = u.ParseAttrs(cps)
+			u.RawAttrs = nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	ats := &u.Attrs
+
+	// split prefixes by address family
+	split := func(prefixes []netip.Prefix) (ipv4, ipv6 []netip.Prefix) {
+		for _, p := range prefixes {
+			if p.Addr().Is4() {
+				ipv4 = append(ipv4, p)
+			} else {
+				ipv6 = append(ipv6, p)
+			}
+		}
+		return
+	}
+	mp := func(ac attrs.Code, prefixes []netip.Prefix) *attrs.MPPrefixes {
+		a := ats.Use(ac).(*attrs.MP)
+		a.AF = af.New(af.AFI_IPV6, af.SAFI_UNICAST)
+		pfx := attrs.NewMPPrefixes(a).(*attrs.MPPrefixes)
+		pfx.Prefixes = prefixes
+		a.Value = pfx
+		return pfx
+	}
+
+	// withdrawn
+	ipv4, ipv6 := split(unreach)
+	u.Unreach = append(u.Unreach, ipv4...)
+	if len(ipv6) > 0 {
+		mp(attrs.ATTR_MP_UNREACH, ipv6)
+	}
+
+	// announced
+	ipv4, ipv6 = split(reach)
+	u.Reach = append(u.Reach, ipv4...)
+	if len(ipv6) > 0 {
+		pfx := mp(attrs.ATTR_MP_REACH, ipv6)
+		pfx.NextHop = nexthop
+		pfx.LinkLocal = nexthop_ll
+	} else if len(ipv4) > 0 && nexthop.Is4() {
+		ats.Use(attrs.ATTR_NEXTHOP).(*attrs.IP).Addr = nexthop
+	}
+
+	// path attributes
+	if origin >= 0 {
+		ats.Use(attrs.ATTR_ORIGIN).(*attrs.Origin).Origin = byte(origin)
+	}
+	if aspath != nil {
+		ats.Use(attrs.ATTR_ASPATH).(*attrs.Aspath).Segments = aspath
+	}
+	if med >= 0 {
+		ats.Use(attrs.ATTR_MED).(*attrs.U32).Val = uint32(med)
+	}
+	if localpref >= 0 {
+		ats.Use(attrs.ATTR_LOCALPREF).(*attrs.U32).Val = uint32(localpref)
+	}
+	if len(coms) > 0 {
+		a := ats.Use(attrs.ATTR_COMMUNITY).(*attrs.Community)
+		for _, c := range coms {
+			a.Add(uint16(c>>16), uint16(c))
+		}
+	}
+	if len(large) > 0 {
+		a := ats.Use(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom)
+		for _, lc := range large {
+			a.Add(lc[0], lc[1], lc[2])
+		}
+	}
+
+	return nil
+}
+
+// fromData sets m to a BGP message of type typ with given data, copied
+func fromData(m *msg.Msg, typ msg.Type, data []byte) error {
+	l := msg.HEADLEN + len(data)
+	if l > 0xffff {
+		return ErrLength
+	}
+
+	buf := make([]byte, 0, l)
+	buf = append(buf, msg.BgpMarker...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(l))
+	buf = append(buf, byte(typ))
+	buf = append(buf, data...)
+	if _, err := m.FromBytes(buf); err != nil {
+		return err
+	}
+	m.CopyData()
+	return nil
+}
+
+// protoEach calls cb for each field in Protobuf message buf.
+// For varint fields, v holds the value; for bytes fields, b holds the data.
+func protoEach(buf []byte, cb func(num protowire.Number, v uint64, b []byte) error) error {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+
+		var (
+			v uint64
+			b []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(buf)
+		case protowire.BytesType:
+			b, n = protowire.ConsumeBytes(buf)
+			if b == nil {
+				b = []byte{}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+
+		if typ == protowire.VarintType || typ == protowire.BytesType {
+			if err := cb(num, v, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// protoPacked appends repeated uint32 value(s) to dst, either packed in b or as v
+func protoPacked(dst []uint32, v uint64, b []byte) ([]uint32, error) {
+	if b == nil {
+		return append(dst, uint32(v)), nil
+	}
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return dst, protowire.ParseError(n)
+		}
+		dst = append(dst, uint32(v))
+		b = b[n:]
+	}
+	return dst, nil
+}
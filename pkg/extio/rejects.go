@@ -0,0 +1,78 @@
+package extio
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// rejects_MAXLEN is the max. length of input written to --rejects
+const rejects_MAXLEN = 64 * 1024
+
+// rejects writes rejected input to a file, as JSON lines
+type rejects struct {
+	sync.Mutex
+	fh *os.File
+}
+
+// rejectLine represents a line in the --rejects file
+type rejectLine struct {
+	Time   string `json:"time"`             // when rejected
+	Stage  string `json:"stage"`            // stage name
+	Source string `json:"source,omitempty"` // input source, eg. websocket remote
+	Line   int64  `json:"line"`             // input line (or message) number
+	Error  string `json:"error"`            // parse error
+	Input  string `json:"input,omitempty"`  // verbatim input (text formats)
+	Hex    string `json:"hex,omitempty"`    // hex-encoded input (binary formats)
+}
+
+// reject handles input buf from src rejected due to parse_err: emits
+// the PARSE_ERROR event and writes to --rejects, if enabled.
+func (eio *Extio) reject(src string, line int64, buf []byte, parse_err error) {
+	count := eio.nrejected.Add(1)
+	if src == "" {
+		src = eio.Source
+	}
+	eio.Event("PARSE_ERROR", parse_err, count, src, line)
+
+	// write to file?
+	rj := eio.rejects
+	if rj == nil {
+		return
+	}
+
+	rl := rejectLine{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Stage:  eio.String(),
+		Source: src,
+		Line:   line,
+		Error:  parse_err.Error(),
+	}
+	if len(buf) > rejects_MAXLEN {
+		buf = buf[:rejects_MAXLEN]
+	}
+	if eio.isBinary() {
+		rl.Hex = hex.EncodeToString(buf)
+	} else {
+		rl.Input = string(buf)
+	}
+
+	out, err := json.Marshal(&rl)
+	if err != nil {
+		return
+	}
+	out = append(out, '\n')
+
+	rj.Lock()
+	defer rj.Unlock()
+	if _, err := rj.fh.Write(out); err != nil {
+		eio.Warn().Err(err).Msg("could not write to --rejects file")
+	}
+}
+
+// isBinary returns true iff input format is binary
+func (eio *Extio) isBinary() bool {
+	return eio.opt_raw || eio.opt_mrt || eio.opt_pcap || eio.opt_proto
+}
@@ -0,0 +1,262 @@
+package extio
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/caps"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/valyala/bytebufferpool"
+)
+
+// ANSI terminal colors for --pretty
+const (
+	ansi_RESET  = "\x1b[0m"
+	ansi_DIM    = "\x1b[2m"
+	ansi_RED    = "\x1b[31m"
+	ansi_GREEN  = "\x1b[32m"
+	ansi_YELLOW = "\x1b[33m"
+	ansi_BLUE   = "\x1b[34m"
+	ansi_PURPLE = "\x1b[35m"
+	ansi_CYAN   = "\x1b[36m"
+)
+
+// writeBgpdump writes m to bb in the format of "bgpdump -m", one line per
+// prefix in a BGP UPDATE. Other messages produce no output.
+func (eio *Extio) writeBgpdump(bb *bytebufferpool.ByteBuffer, m *msg.Msg) error {
+	if m.Type != msg.UPDATE {
+		return nil
+	} else if err := m.Parse(eio.P.Caps); err != nil {
+		return err
+	}
+
+	// common line prefix
+	b4 := eio.msgPeer(m)
+	head := append([]byte("BGP4MP|"), strconv.FormatInt(m.Time.Unix(), 10)...)
+	peer := "|" + addrString(b4.peerIP) + "|" + strconv.FormatUint(uint64(b4.peerAS), 10) + "|"
+
+	// withdrawn
+	u := &m.Update
+	ats := &u.Attrs
+	withdraw := func(prefixes []netip.Prefix) {
+		for _, p := range prefixes {
+			bb.B = append(bb.B, head...)
+			bb.B = append(bb.B, "|W"...)
+			bb.B = append(bb.B, peer...)
+			bb.B = append(bb.B, p.String()...)
+			bb.B = append(bb.B, '\n')
+		}
+	}
+	withdraw(u.Unreach)
+	if mp := ats.MPPrefixes(attrs.ATTR_MP_UNREACH); mp != nil {
+		withdraw(mp.Prefixes)
+	}
+
+	// common attributes of announced prefixes, before and after the next hop
+	var mid, tail []byte
+	mid = append(mid, '|')
+	mid = append(mid, csvAspath(ats.AsPath())...)
+	mid = append(mid, '|')
+	if a, ok := ats.Get(attrs.ATTR_ORIGIN).(*attrs.Origin); ok {
+		switch a.Origin {
+		case 0:
+			mid = append(mid, "IGP"...)
+		case 1:
+			mid = append(mid, "EGP"...)
+		default:
+			mid = append(mid, "INCOMPLETE"...)
+		}
+	}
+	mid = append(mid, '|')
+	tail = append(tail, '|')
+	if a, ok := ats.Get(attrs.ATTR_LOCALPREF).(*attrs.U32); ok {
+		tail = strconv.AppendUint(tail, uint64(a.Val), 10)
+	} else {
+		tail = append(tail, '0')
+	}
+	tail = append(tail, '|')
+	if a, ok := ats.Get(attrs.ATTR_MED).(*attrs.U32); ok {
+		tail = strconv.AppendUint(tail, uint64(a.Val), 10)
+	} else {
+		tail = append(tail, '0')
+	}
+	tail = append(tail, '|')
+	tail = append(tail, csvCommunities(ats)...)
+	if ats.Has(attrs.ATTR_AGGREGATE) {
+		tail = append(tail, "|AG|"...)
+	} else {
+		tail = append(tail, "|NAG|"...)
+	}
+	if a, ok := ats.Get(attrs.ATTR_AGGREGATOR).(*attrs.Aggregator); ok {
+		tail = strconv.AppendUint(tail, uint64(a.ASN), 10)
+		tail = append(tail, ' ')
+		tail = append(tail, a.Addr.String()...)
+	}
+	tail = append(tail, "|\n"...)
+
+	// announced
+	announce := func(nh netip.Addr, prefixes []netip.Prefix) {
+		for _, p := range prefixes {
+			bb.B = append(bb.B, head...)
+			bb.B = append(bb.B, "|A"...)
+			bb.B = append(bb.B, peer...)
+			bb.B = append(bb.B, p.String()...)
+			bb.B = append(bb.B, mid...)
+			bb.B = append(bb.B, addrString(nh)...)
+			bb.B = append(bb.B, tail...)
+		}
+	}
+	if len(u.Reach) > 0 {
+		var nh netip.Addr
+		if a, ok := ats.Get(attrs.ATTR_NEXTHOP).(*attrs.IP); ok {
+			nh = a.Addr
+		}
+		announce(nh, u.Reach)
+	}
+	if mp := ats.MPPrefixes(attrs.ATTR_MP_REACH); mp != nil {
+		announce(mp.NextHop, mp.Prefixes)
+	}
+
+	return nil
+}
+
+// writePretty writes m to bb as a human-readable line of text,
+// using ANSI terminal colors iff eio.Color is true.
+func (eio *Extio) writePretty(bb *bytebufferpool.ByteBuffer, m *msg.Msg) error {
+	color := func(c string) {
+		if eio.Color {
+			bb.B = append(bb.B, c...)
+		}
+	}
+
+	// header
+	color(ansi_DIM)
+	bb.B = m.Time.AppendFormat(bb.B, time.DateTime+".000")
+	color(ansi_RESET)
+	bb.B = append(bb.B, ' ')
+	if m.Dir == msg.DIR_L {
+		color(ansi_BLUE)
+	} else {
+		color(ansi_YELLOW)
+	}
+	bb.B = append(bb.B, m.Dir.String()...)
+	bb.B = append(bb.B, " #"...)
+	bb.B = strconv.AppendInt(bb.B, m.Seq, 10)
+	color(ansi_RESET)
+	bb.B = append(bb.B, ' ')
+
+	// message type
+	switch m.Type {
+	case msg.OPEN, msg.UPDATE:
+		color(ansi_CYAN)
+	case msg.NOTIFY:
+		color(ansi_RED)
+	default:
+		color(ansi_DIM)
+	}
+	bb.B = append(bb.B, m.Type.String()...)
+	color(ansi_RESET)
+
+	// message contents
+	if m.Type == msg.OPEN || m.Type == msg.UPDATE {
+		if err := m.Parse(eio.P.Caps); err != nil {
+			return err
+		}
+	}
+	switch m.Type {
+	case msg.OPEN:
+		o := &m.Open
+		bb.B = append(bb.B, " AS"...)
+		bb.B = strconv.AppendInt(bb.B, int64(o.GetASN()), 10)
+		bb.B = append(bb.B, " hold="...)
+		bb.B = strconv.AppendUint(bb.B, uint64(o.HoldTime), 10)
+		bb.B = append(bb.B, " id="...)
+		bb.B = append(bb.B, addrString(o.Identifier)...)
+		bb.B = append(bb.B, " caps="...)
+		o.Caps.Each(func(i int, cc caps.Code, _ caps.Cap) {
+			if i > 0 {
+				bb.B = append(bb.B, ',')
+			}
+			bb.B = append(bb.B, cc.String()...)
+		})
+
+	case msg.UPDATE:
+		u := &m.Update
+		ats := &u.Attrs
+		prefixes := func(c, sign string, prefixes []netip.Prefix) {
+			for _, p := range prefixes {
+				bb.B = append(bb.B, ' ')
+				color(c)
+				bb.B = append(bb.B, sign...)
+				bb.B = append(bb.B, p.String()...)
+				color(ansi_RESET)
+			}
+		}
+
+		// prefixes
+		prefixes(ansi_RED, "-", u.Unreach)
+		if mp := ats.MPPrefixes(attrs.ATTR_MP_UNREACH); mp != nil {
+			prefixes(ansi_RED, "-", mp.Prefixes)
+		}
+		prefixes(ansi_GREEN, "+", u.Reach)
+		var nh netip.Addr
+		if a, ok := ats.Get(attrs.ATTR_NEXTHOP).(*attrs.IP); ok {
+			nh = a.Addr
+		}
+		if mp := ats.MPPrefixes(attrs.ATTR_MP_REACH); mp != nil {
+			prefixes(ansi_GREEN, "+", mp.Prefixes)
+			nh = mp.NextHop
+		}
+
+		// selected attributes
+		attr := func(key, val string) {
+			if len(val) > 0 {
+				bb.B = append(bb.B, ' ')
+				color(ansi_PURPLE)
+				bb.B = append(bb.B, key...)
+				color(ansi_RESET)
+				bb.B = append(bb.B, '=')
+				bb.B = append(bb.B, val...)
+			}
+		}
+		if nh.IsValid() {
+			attr("nexthop", nh.String())
+		}
+		if asp := ats.AsPath(); asp != nil {
+			attr("aspath", "["+csvAspath(asp)+"]")
+		}
+		attr("communities", csvCommunities(ats))
+
+	case msg.KEEPALIVE:
+		break
+
+	default:
+		if len(m.Data) > 0 {
+			bb.B = append(bb.B, ' ')
+			bb.B = append(bb.B, hex.EncodeToString(m.Data)...)
+		}
+	}
+
+	// tags
+	if pipe.HasTags(m) {
+		bb.B = append(bb.B, ' ')
+		color(ansi_DIM)
+		bb.B = append(bb.B, csvTags(m)...)
+		color(ansi_RESET)
+	}
+
+	bb.B = append(bb.B, '\n')
+	return nil
+}
+
+// addrString returns addr as string, or empty string if addr is invalid
+func addrString(addr netip.Addr) string {
+	if addr.IsValid() {
+		return addr.String()
+	}
+	return ""
+}
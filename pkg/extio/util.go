@@ -1,5 +1,12 @@
 package extio
 
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
 func close_safe[T any](ch chan T) (ok bool) {
 	if ch != nil {
 		defer func() { recover() }()
@@ -17,3 +24,77 @@ func send_safe[T any](ch chan T, v T) (ok bool) {
 	}
 	return
 }
+
+// send_wait sends v to ch, waiting up to d (not at all if d is zero).
+// Returns sent=true on success, and ok=false if ch is nil or closed.
+func send_wait[T any](ch chan T, v T, d time.Duration) (sent, ok bool) {
+	if ch == nil {
+		return false, false
+	}
+	defer func() {
+		if recover() != nil {
+			sent, ok = false, false
+		}
+	}()
+
+	select {
+	case ch <- v:
+		return true, true
+	default:
+		if d == 0 {
+			return false, true
+		}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case ch <- v:
+		return true, true
+	case <-timer.C:
+		return false, true
+	}
+}
+
+// ParsePrefixes parses IP addresses or prefixes in vals
+func ParsePrefixes(vals []string) (ret []netip.Prefix, err error) {
+	for _, v := range vals {
+		if v = strings.TrimSpace(v); len(v) == 0 {
+			continue
+		}
+
+		var p netip.Prefix
+		if strings.IndexByte(v, '/') >= 0 {
+			p, err = netip.ParsePrefix(v)
+		} else if a, err2 := netip.ParseAddr(v); err2 == nil {
+			p = netip.PrefixFrom(a, a.BitLen())
+		} else {
+			err = err2
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, p.Masked())
+	}
+	return ret, nil
+}
+
+// MatchPrefixes returns true iff IP address in addr is in any of prefixes.
+// addr may also be in host:port form, eg. a remote address.
+func MatchPrefixes(prefixes []netip.Prefix, addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap().WithZone("")
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package stages
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+	"github.com/spf13/pflag"
+)
+
+// authConfig implements the TLS and HTTP auth options of HTTP-based stages
+type authConfig struct {
+	*core.StageBase
+
+	tls    *tls.Config                 // TLS config (nil if not secure)
+	certs  *reloader[*tls.Certificate] // --cert and --key (may be nil)
+	cas    *reloader[*x509.CertPool]   // --ca (may be nil)
+	basic  *reloader[[]string]         // --auth user:pass (may be nil)
+	tokens *reloader[[]string]         // --token (may be nil)
+	allow  []netip.Prefix              // --allow
+}
+
+// addAuthFlags adds the authConfig flags to f
+func addAuthFlags(f *pflag.FlagSet) {
+	f.String("auth", "", "use HTTP basic auth ($ENV_VARIABLE or file path with user:pass lines)")
+	f.String("token", "", "use HTTP bearer token auth ($ENV_VARIABLE or file path with token lines)")
+	addTLSFlags(f)
+}
+
+// addTLSFlags adds the authConfig flags to f, except for HTTP auth
+func addTLSFlags(f *pflag.FlagSet) {
+	f.String("cert", "", "SSL certificate path")
+	f.String("key", "", "SSL private key path")
+	f.String("ca", "", "SSL CA bundle path to verify the remote certificate (server: require client certificates)")
+	f.StringSlice("allow-name", []string{}, "allowed remote certificate names (subject CN or SAN)")
+	f.StringSlice("pin", []string{}, "allowed remote certificate SHA-256 fingerprints (no CA needed)")
+	f.StringSlice("allow", []string{}, "server: allowed client IP addresses or prefixes")
+	f.Bool("insecure", false, "do not verify the SSL certificate")
+}
+
+// attach configures a from the stage flags.
+// If secure is set, prepares a.tls. If server is set, configures the server side.
+// All files are reloaded on change.
+func (a *authConfig) attach(secure, server bool) (err error) {
+	k := a.K
+
+	// SSL config
+	names := k.Strings("allow-name")
+	pins, err := parsePins(k.Strings("pin"))
+	if err != nil {
+		return fmt.Errorf("--pin: %w", err)
+	}
+	if secure {
+		a.tls = &tls.Config{}
+
+		// skip SSL cert verify?
+		if k.Bool("insecure") {
+			a.tls.InsecureSkipVerify = true
+		}
+
+		// load certificate and key
+		if k.String("cert") != "" && k.String("key") != "" {
+			a.certs, err = newCertReloader(k.String("cert"), k.String("key"))
+			if err != nil {
+				return fmt.Errorf("--cert and --key: %w", err)
+			}
+			if server {
+				a.tls.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+					return a.getCert()
+				}
+			} else {
+				a.tls.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return a.getCert()
+				}
+			}
+		} else if server {
+			return fmt.Errorf("SSL server requires --cert and --key")
+		}
+
+		// load CA bundle
+		if v := k.String("ca"); v != "" {
+			a.cas, err = newCAReloader(v)
+			if err != nil {
+				return fmt.Errorf("--ca: %w", err)
+			}
+			if server {
+				a.tls.ClientAuth = tls.RequireAndVerifyClientCert
+				a.tls.GetConfigForClient = a.serverTLS
+			}
+		} else if len(pins) > 0 {
+			// pinned certificates need no CA
+			if server {
+				a.tls.ClientAuth = tls.RequireAnyClientCert
+			} else {
+				a.tls.InsecureSkipVerify = true
+			}
+		} else if server && len(names) > 0 {
+			return fmt.Errorf("--allow-name: requires --ca or --pin")
+		}
+
+		// check remote certificate name and fingerprint?
+		if len(names) > 0 || len(pins) > 0 {
+			a.tls.VerifyConnection = verifyCert(names, pins)
+		}
+	} else if k.String("ca") != "" || len(names) > 0 || len(pins) > 0 {
+		return fmt.Errorf("--ca, --allow-name, and --pin: require SSL")
+	}
+
+	// client IP allowlist
+	if v := k.Strings("allow"); len(v) > 0 {
+		if !server {
+			return fmt.Errorf("--allow: requires server mode")
+		}
+		a.allow, err = extio.ParsePrefixes(v)
+		if err != nil {
+			return fmt.Errorf("--allow: %w", err)
+		}
+	}
+
+	// HTTP basic auth
+	if v := k.String("auth"); len(v) > 0 {
+		a.basic, err = newSecretReloader(v)
+		if err != nil {
+			return fmt.Errorf("--auth: %w", err)
+		}
+		creds, _ := a.basic.Get()
+		for _, cred := range creds {
+			if strings.IndexByte(cred, ':') < 0 {
+				return fmt.Errorf("--auth: invalid format, need user:pass")
+			}
+		}
+	}
+
+	// HTTP bearer token auth
+	if v := k.String("token"); len(v) > 0 {
+		if a.basic != nil && !server {
+			return fmt.Errorf("--token: can't use with --auth in client mode")
+		}
+		a.tokens, err = newSecretReloader(v)
+		if err != nil {
+			return fmt.Errorf("--token: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// connCheck checks if a new server conn from remote (host:port) is allowed
+func (a *authConfig) connCheck(remote string) error {
+	if len(a.allow) > 0 && !extio.MatchPrefixes(a.allow, remote) {
+		return fmt.Errorf("client IP not allowed")
+	}
+	return nil
+}
+
+// getCert returns the current --cert and --key certificate
+func (a *authConfig) getCert() (*tls.Certificate, error) {
+	cert, err := a.certs.Get()
+	if err != nil {
+		a.Warn().Err(err).Msg("--cert and --key: could not reload, using the previous version")
+	}
+	return cert, nil
+}
+
+// serverTLS returns the TLS config for a new server connection, using the current --ca bundle
+func (a *authConfig) serverTLS(*tls.ClientHelloInfo) (*tls.Config, error) {
+	pool, err := a.cas.Get()
+	if err != nil {
+		a.Warn().Err(err).Msg("--ca: could not reload, using the previous version")
+	}
+	cfg := a.tls.Clone()
+	cfg.GetConfigForClient = nil
+	cfg.ClientCAs = pool
+	return cfg, nil
+}
+
+// clientTLS returns the TLS config for a new client connection, using the current --ca bundle
+func (a *authConfig) clientTLS() *tls.Config {
+	if a.cas == nil {
+		return a.tls
+	}
+
+	pool, err := a.cas.Get()
+	if err != nil {
+		a.Warn().Err(err).Msg("--ca: could not reload, using the previous version")
+	}
+	cfg := a.tls.Clone()
+	cfg.RootCAs = pool
+	return cfg
+}
+
+// clientAuth sets the Authorization header in h for a new client request, if needed
+func (a *authConfig) clientAuth(h http.Header) {
+	if a.basic != nil {
+		creds, err := a.basic.Get()
+		if err != nil {
+			a.Warn().Err(err).Msg("--auth: could not reload, using the previous version")
+		}
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds[0])))
+	} else if a.tokens != nil {
+		tokens, err := a.tokens.Get()
+		if err != nil {
+			a.Warn().Err(err).Msg("--token: could not reload, using the previous version")
+		}
+		h.Set("Authorization", "Bearer "+tokens[0])
+	}
+}
+
+// serverCheck checks if client request r is allowed. If not, it writes an error response
+// to w, emits the "denied" event, and returns false.
+func (a *authConfig) serverCheck(w http.ResponseWriter, r *http.Request) bool {
+	// client IP allowed?
+	if len(a.allow) > 0 && !extio.MatchPrefixes(a.allow, r.RemoteAddr) {
+		a.Warn().Msgf("%s: client IP not allowed", r.RemoteAddr)
+		a.Event("denied", r.RemoteAddr, "ip")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	// authorized?
+	if reason := a.serverAuth(r.Header.Get("Authorization")); reason != "" {
+		a.Warn().Msgf("%s: unauthorized: %s", r.RemoteAddr, reason)
+		a.Event("denied", r.RemoteAddr, reason)
+		if a.basic != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bgpipe"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bgpipe"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// serverAuth checks the Authorization header value of a client request, returning the reason if denied
+func (a *authConfig) serverAuth(auth string) string {
+	if a.basic == nil && a.tokens == nil {
+		return "" // no auth required
+	}
+
+	scheme, val, _ := strings.Cut(auth, " ")
+	switch {
+	case auth == "":
+		return "no credentials"
+	case a.basic != nil && strings.EqualFold(scheme, "Basic"):
+		cred, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+		if err != nil {
+			return "invalid basic auth"
+		}
+		creds, err := a.basic.Get()
+		if err != nil {
+			a.Warn().Err(err).Msg("--auth: could not reload, using the previous version")
+		}
+		if matchSecret(creds, string(cred)) {
+			return ""
+		}
+		return "invalid basic auth"
+	case a.tokens != nil && strings.EqualFold(scheme, "Bearer"):
+		tokens, err := a.tokens.Get()
+		if err != nil {
+			a.Warn().Err(err).Msg("--token: could not reload, using the previous version")
+		}
+		if matchSecret(tokens, strings.TrimSpace(val)) {
+			return ""
+		}
+		return "invalid token"
+	default:
+		return "invalid auth scheme"
+	}
+}
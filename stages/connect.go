@@ -2,6 +2,7 @@ package stages
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/netip"
@@ -16,6 +17,9 @@ type Connect struct {
 	in *pipe.Input
 
 	target string
+	source *net.TCPAddr // --source (may be nil)
+	tcp    tcpConfig    // socket options
+	auth   authConfig   // --tls config
 	conn   net.Conn
 }
 
@@ -25,6 +29,8 @@ func NewConnect(parent *core.StageBase) core.Stage {
 		o = &s.Options
 		f = o.Flags
 	)
+	s.tcp.StageBase = parent
+	s.auth.StageBase = parent
 
 	o.Descr = "connect to a BGP endpoint over TCP"
 	o.IsProducer = true
@@ -32,6 +38,11 @@ func NewConnect(parent *core.StageBase) core.Stage {
 
 	f.Duration("timeout", time.Minute, "connect timeout (0 means none)")
 	f.String("md5", "", "TCP MD5 password")
+	addAoFlags(f)
+	f.String("source", "", "local IP address (and port) to connect from")
+	addTcpFlags(f)
+	f.Bool("tls", false, "connect over TLS")
+	addTLSFlags(f)
 	o.Args = []string{"addr"}
 
 	return s
@@ -55,6 +66,27 @@ func (s *Connect) Attach() error {
 		}
 	}
 
+	// source address?
+	if v := s.K.String("source"); len(v) > 0 {
+		if ap, err := netip.ParseAddrPort(v); err == nil {
+			s.source = net.TCPAddrFromAddrPort(ap)
+		} else if a, err := netip.ParseAddr(v); err == nil {
+			s.source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(a, 0))
+		} else {
+			return fmt.Errorf("--source: invalid IP address: %s", v)
+		}
+	}
+
+	// socket options
+	if err := s.tcp.attach(); err != nil {
+		return err
+	}
+
+	// TLS config
+	if err := s.auth.attach(s.K.Bool("tls"), false); err != nil {
+		return err
+	}
+
 	s.in = s.P.AddInput(s.Dir)
 	return nil
 }
@@ -70,8 +102,13 @@ func (s *Connect) Prepare() error {
 	}
 
 	// dialer
-	var dialer net.Dialer
-	dialer.Control = tcp_md5(s.K.String("md5"))
+	dialer := net.Dialer{
+		Control:   s.tcp.control(),
+		KeepAlive: s.tcp.keepalive,
+	}
+	if s.source != nil {
+		dialer.LocalAddr = s.source
+	}
 
 	// dial
 	s.Info().Msgf("dialing %s", s.target)
@@ -80,6 +117,23 @@ func (s *Connect) Prepare() error {
 		return err
 	}
 
+	// TLS handshake?
+	if s.auth.tls != nil {
+		cfg := s.auth.clientTLS()
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(s.target)
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return fmt.Errorf("TLS handshake: %w", err)
+		}
+		s.Info().Str("tls", tls.VersionName(tc.ConnectionState().Version)).
+			Msgf("TLS connected to %s", tc.ConnectionState().PeerCertificates[0].Subject)
+		conn = tc
+	}
+
 	// success
 	s.conn = conn
 	return nil
@@ -5,12 +5,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"net/netip"
 	"os/exec"
+	"sync/atomic"
 	"time"
 
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
 	"github.com/bgpfix/bgpipe/core"
 	"github.com/bgpfix/bgpipe/pkg/extio"
+	"github.com/puzpuzpuz/xsync/v3"
+	"github.com/rs/zerolog"
+	"github.com/valyala/bytebufferpool"
 )
 
 type Exec struct {
@@ -18,12 +26,44 @@ type Exec struct {
 
 	cmd_path string
 	cmd_args []string
+
+	opt_restart  string        // --restart
+	opt_delay    time.Duration // --restart-delay
+	opt_maxdelay time.Duration // --restart-max-delay
+	opt_rate     int           // --restart-rate
+	opt_failopen bool          // --fail-open
+	opt_workers  int           // --workers
+	opt_balance  string        // --balance
+	opt_verdict  bool          // --verdict
+	opt_vtimeout time.Duration // --verdict-timeout
+	opt_vfail    string        // --verdict-fail
+	opt_vinject  bool          // --verdict-inject
+
+	workers  []*execWorker // command instances
+	next     atomic.Uint32 // next worker for --balance rr
+	reorder  *execReorder  // re-orders worker output (nil if not needed)
+	stopping atomic.Bool   // Stop() called?
+
+	vid      atomic.Uint64                           // last --verdict message id
+	verdicts *xsync.MapOf[uint64, chan *execVerdict] // pending verdicts
+
+	eio *extio.Extio
+}
+
+// execWorker runs a single instance of the command
+type execWorker struct {
+	zerolog.Logger
+	s  *Exec
+	id int // worker index
+
 	cmd_exec *exec.Cmd
 	cmd_in   io.WriteCloser // stdin
 	cmd_out  io.ReadCloser  // stdout
 	cmd_err  io.ReadCloser  // stderr
 
-	eio *extio.Extio
+	output   chan *bytebufferpool.ByteBuffer // messages to write to stdin
+	restarts []time.Time                     // recent restart times, for --restart-rate
+	down     atomic.Bool                     // command not running?
 }
 
 func NewExec(parent *core.StageBase) core.Stage {
@@ -41,6 +81,24 @@ func NewExec(parent *core.StageBase) core.Stage {
 	f := o.Flags
 	f.Bool("keep-stdin", false, "keep running if stdin is closed")
 	f.Bool("keep-stdout", false, "keep running if stdout is closed")
+	f.String("restart", "no", "restart the process when it exits: no, on-failure, always")
+	f.Duration("restart-delay", time.Second, "initial delay before restart (doubled on each failure)")
+	f.Duration("restart-max-delay", 30*time.Second, "maximum delay before restart")
+	f.Int("restart-rate", 10, "maximum number of restarts per minute (0 means no limit)")
+	f.Bool("fail-open", false, "pass messages through untouched while the process is down")
+	f.Int("workers", 1, "number of processes to run in parallel")
+	f.String("balance", "rr", "how to distribute messages among --workers: rr (round-robin), prefix")
+	f.Duration("reorder-timeout", 10*time.Second, "with --workers, max. time to wait for a message before assuming it was dropped")
+	f.Bool("verdict", false, "ask the process for accept/drop/replace verdict on each message")
+	f.Duration("verdict-timeout", time.Second, "max. time to wait for a --verdict")
+	f.String("verdict-fail", "open", "on --verdict timeout or invalid replacement: open (accept the message), closed (drop it)")
+	f.Bool("verdict-inject", false, "with --verdict, accept new messages from the process too (not only verdicts)")
+
+	o.Events = map[string]string{
+		"exit":    "process exited (value: error)",
+		"restart": "process restarted (value: restart count)",
+		"timeout": "no --verdict in time (value: message id)",
+	}
 
 	s.eio = extio.NewExtio(parent, 0)
 	return s
@@ -54,70 +112,349 @@ func (s *Exec) Attach() error {
 	if len(s.cmd_path) == 0 {
 		return errors.New("needs path to the executable")
 	}
+	s.eio.Source = s.cmd_path
 
-	// create cmd
-	var err error
-	s.cmd_exec = exec.CommandContext(s.Ctx, s.cmd_path, s.cmd_args...)
-	s.cmd_in, err = s.cmd_exec.StdinPipe()
-	if err != nil {
-		return err
+	// restart policy
+	s.opt_restart = k.String("restart")
+	switch s.opt_restart {
+	case "no", "on-failure", "always":
+	default:
+		return fmt.Errorf("--restart: invalid value: %s", s.opt_restart)
 	}
-	s.cmd_out, err = s.cmd_exec.StdoutPipe()
-	if err != nil {
-		return err
+	s.opt_delay = k.Duration("restart-delay")
+	s.opt_maxdelay = k.Duration("restart-max-delay")
+	if s.opt_delay <= 0 || s.opt_maxdelay < s.opt_delay {
+		return fmt.Errorf("--restart-delay: must be positive and at most --restart-max-delay")
 	}
-	s.cmd_err, err = s.cmd_exec.StderrPipe()
-	if err != nil {
-		return err
+	s.opt_rate = k.Int("restart-rate")
+	s.opt_failopen = k.Bool("fail-open")
+	if s.opt_failopen && s.opt_restart == "no" {
+		return fmt.Errorf("--fail-open: needs --restart")
 	}
 
-	// cleanup procedure
-	// s.cmd_exec.Cancel = func() error { close_safe(s.eio.Output); return nil }
-	s.cmd_exec.WaitDelay = time.Second
+	// worker pool
+	s.opt_workers = k.Int("workers")
+	if s.opt_workers < 1 {
+		return fmt.Errorf("--workers: must be at least 1")
+	}
+	s.opt_balance = k.String("balance")
+	switch s.opt_balance {
+	case "rr", "prefix":
+	default:
+		return fmt.Errorf("--balance: invalid value: %s", s.opt_balance)
+	}
+	if s.opt_workers > 1 && (k.Bool("raw") || k.Bool("mrt") || k.Bool("pcap")) {
+		return fmt.Errorf("--workers: needs JSON or --proto")
+	}
+
+	// verdict protocol
+	s.opt_verdict = k.Bool("verdict")
+	s.opt_vtimeout = k.Duration("verdict-timeout")
+	s.opt_vfail = k.String("verdict-fail")
+	s.opt_vinject = k.Bool("verdict-inject")
+	if s.opt_vinject && !s.opt_verdict {
+		return fmt.Errorf("--verdict-inject: needs --verdict")
+	}
+	if s.opt_verdict {
+		switch {
+		case s.opt_vtimeout <= 0:
+			return fmt.Errorf("--verdict-timeout: must be positive")
+		case s.opt_vfail != "open" && s.opt_vfail != "closed":
+			return fmt.Errorf("--verdict-fail: invalid value: %s", s.opt_vfail)
+		case s.opt_workers > 1:
+			return fmt.Errorf("--verdict: not supported with --workers")
+		case k.Bool("copy") || k.Bool("read") || k.Bool("write"):
+			return fmt.Errorf("--verdict: not supported with --copy, --read, or --write")
+		case k.Bool("raw") || k.Bool("mrt") || k.Bool("pcap") || k.Bool("proto"):
+			return fmt.Errorf("--verdict: needs JSON")
+		}
+		s.verdicts = xsync.NewMapOf[uint64, chan *execVerdict]()
+	}
+
+	// create cmd(s)
+	for i := 0; i < s.opt_workers; i++ {
+		w := &execWorker{s: s, id: i}
+		if err := w.newCmd(); err != nil {
+			return err
+		}
+		s.workers = append(s.workers, w)
+	}
 
 	// FIXME: move to extio
 	if k.Bool("write") {
 		s.Options.IsProducer = false
 	}
 
-	return s.eio.Attach()
+	if err := s.eio.Attach(); err != nil {
+		return err
+	}
+
+	// distribute among workers?
+	if s.opt_verdict {
+		s.workers[0].output = s.eio.Output
+		s.eio.Callback.Func = s.verdictMsg // instead of eio.SendMsg
+	} else if s.opt_workers == 1 {
+		s.workers[0].output = s.eio.Output
+	} else {
+		s.eio.NewShards(s.opt_workers)
+		for i, w := range s.workers {
+			w.output = s.eio.Shards[i]
+		}
+		s.eio.Shard = s.shard
+
+		// re-order the output iff filtering
+		if !k.Bool("copy") && !k.Bool("write") && !k.Bool("read") {
+			if k.Bool("no-seq") {
+				return fmt.Errorf("--workers: needs message seq numbers to re-order the output, can't use --no-seq")
+			}
+			s.reorder = newExecReorder(s.eio, s.opt_workers, k.Duration("reorder-timeout"))
+		}
+	}
+
+	return nil
+}
+
+// shard selects the worker for m
+func (s *Exec) shard(m *msg.Msg) int {
+	var i int
+	if p, ok := firstPrefix(m); ok && s.opt_balance == "prefix" {
+		i = hashPrefix(p, len(s.workers))
+	} else {
+		i = int(s.next.Add(1) % uint32(len(s.workers)))
+	}
+
+	// worker down?
+	if s.opt_failopen && s.workers[i].down.Load() {
+		return -1
+	}
+
+	if s.reorder != nil {
+		s.reorder.dispatch(m, i)
+	}
+	return i
+}
+
+// firstPrefix returns the first IP prefix in m, if m is an UPDATE
+func firstPrefix(m *msg.Msg) (netip.Prefix, bool) {
+	if m.Type != msg.UPDATE {
+		return netip.Prefix{}, false
+	}
+
+	u := &m.Update
+	switch {
+	case len(u.Reach) > 0:
+		return u.Reach[0], true
+	case len(u.Unreach) > 0:
+		return u.Unreach[0], true
+	}
+	for _, at := range []attrs.Code{attrs.ATTR_MP_REACH, attrs.ATTR_MP_UNREACH} {
+		if mp := u.Attrs.MPPrefixes(at); mp != nil && len(mp.Prefixes) > 0 {
+			return mp.Prefixes[0], true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// hashPrefix returns a stable index in [0, n) for p
+func hashPrefix(p netip.Prefix, n int) int {
+	h := fnv.New32a()
+	b := p.Addr().As16()
+	h.Write(b[:])
+	h.Write([]byte{byte(p.Bits())})
+	return int(h.Sum32() % uint32(n))
 }
 
-// Prepare starts the command in background
-func (s *Exec) Prepare() (err error) {
-	s.Info().Msgf("running %s", s.cmd_exec.String())
-	return s.cmd_exec.Start()
+// Prepare starts the command(s) in background
+func (s *Exec) Prepare() error {
+	for _, w := range s.workers {
+		w.Logger = s.Logger
+		if len(s.workers) > 1 {
+			w.Logger = s.With().Int("worker", w.id).Logger()
+		}
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Stop stops the flow of data
 func (s *Exec) Stop() error {
+	s.stopping.Store(true)
 	s.eio.InputClose()
 	s.eio.OutputClose()
 	return nil
 }
 
-// Run runs the data flow
-func (s *Exec) Run() (err error) {
+// Run runs the data flow, until any of the workers fails
+func (s *Exec) Run() error {
+	defer s.eio.OutputClose() // not closed by WriteStreamUntil
+
+	if len(s.workers) == 1 {
+		return s.workers[0].run()
+	}
+
+	// re-order the output
+	if s.reorder != nil {
+		go s.reorder.expire(s.Ctx)
+	}
+
+	// start all, wait for the first error
+	done := make(chan error, len(s.workers))
+	for _, w := range s.workers {
+		go func(w *execWorker) { done <- w.run() }(w)
+	}
+	err := <-done
+
+	// stop the rest
+	s.Cancel(err)
+	for range s.workers[1:] {
+		<-done
+	}
+	return err
+}
+
+// newCmd prepares a new instance of the command
+func (w *execWorker) newCmd() (err error) {
+	s := w.s
+	w.cmd_exec = exec.CommandContext(s.Ctx, s.cmd_path, s.cmd_args...)
+	w.cmd_in, err = w.cmd_exec.StdinPipe()
+	if err != nil {
+		return err
+	}
+	w.cmd_out, err = w.cmd_exec.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	w.cmd_err, err = w.cmd_exec.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	// cleanup procedure
+	// w.cmd_exec.Cancel = func() error { close_safe(s.eio.Output); return nil }
+	w.cmd_exec.WaitDelay = time.Second
+	return nil
+}
+
+// start starts the command in background
+func (w *execWorker) start() error {
+	w.Info().Msgf("running %s", w.cmd_exec.String())
+	return w.cmd_exec.Start()
+}
+
+// setDown marks the worker as down (or up again) for --fail-open
+func (w *execWorker) setDown(down bool) {
+	if len(w.s.workers) == 1 {
+		w.s.eio.Bypass.Store(down)
+	} else {
+		w.down.Store(down)
+	}
+}
+
+// run runs the data flow, restarting the command if needed
+func (w *execWorker) run() error {
+	s := w.s
+	delay := s.opt_delay
+	for count := 1; ; count++ {
+		started := time.Now()
+		err, cmd_err := w.runCmd()
+		s.Event("exit", cmd_err)
+		if s.reorder != nil {
+			s.reorder.flushWorker(w.id)
+		}
+
+		// restart?
+		switch {
+		case s.stopping.Load() || s.Ctx.Err() != nil:
+			return err
+		case s.opt_restart == "always":
+		case s.opt_restart == "on-failure" && cmd_err != nil:
+		default:
+			return err
+		}
+		if err := w.checkRate(); err != nil {
+			return err
+		}
+
+		// pass through while down?
+		if s.opt_failopen {
+			w.setDown(true)
+		}
+
+		// back off, reset if the command ran long enough
+		if time.Since(started) > s.opt_maxdelay {
+			delay = s.opt_delay
+		}
+		w.Warn().Err(err).Msgf("command terminated, restarting in %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-s.Ctx.Done():
+			return context.Cause(s.Ctx)
+		}
+		delay = min(delay*2, s.opt_maxdelay)
+
+		// start again
+		if len(s.workers) == 1 {
+			s.eio.InputReset()
+		}
+		if err := w.newCmd(); err != nil {
+			return err
+		}
+		if err := w.start(); err != nil {
+			return err
+		}
+		w.setDown(false)
+		s.Event("restart", count)
+	}
+}
+
+// checkRate returns an error iff the next restart would exceed --restart-rate
+func (w *execWorker) checkRate() error {
+	s := w.s
+	if s.opt_rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for len(w.restarts) > 0 && now.Sub(w.restarts[0]) > time.Minute {
+		w.restarts = w.restarts[1:]
+	}
+	if len(w.restarts) >= s.opt_rate {
+		return fmt.Errorf("--restart-rate: %d restarts in the last minute", len(w.restarts))
+	}
+
+	w.restarts = append(w.restarts, now)
+	return nil
+}
+
+// runCmd runs the data flow for the current command instance.
+// Returns the data flow error and the command exit error.
+func (w *execWorker) runCmd() (err error, cmd_err error) {
+	s := w.s
+
 	// start stdout reader
 	stdout_reader_done := make(chan error, 1)
 	stdout_ok := s.K.Bool("keep-stdout")
-	go s.stdoutReader(stdout_reader_done)
+	go w.stdoutReader(stdout_reader_done)
 
 	// start stderr reader
 	stderr_reader_done := make(chan error, 1)
-	go s.stderrReader(stderr_reader_done)
+	go w.stderrReader(stderr_reader_done)
 
 	// start stdin writer
 	stdin_writer_done := make(chan error, 1)
+	stdin_writer_stop := make(chan struct{})
 	stdin_ok := s.K.Bool("keep-stdin")
-	go s.stdinWriter(stdin_writer_done)
+	go w.stdinWriter(stdin_writer_done, stdin_writer_stop)
 
 	// cleanup on exit
 	defer func() {
-		// wait for the command
-		s.cmd_exec.Cancel()
-		cmd_err := s.cmd_exec.Wait()
-		s.Err(cmd_err).Msg("command terminated")
+		// stop the stdin writer, wait for the command
+		close(stdin_writer_stop)
+		w.cmd_exec.Cancel()
+		cmd_err = w.cmd_exec.Wait()
+		w.Err(cmd_err).Msg("command terminated")
 
 		// escalate the error?
 		if cmd_err != nil && err == nil {
@@ -129,49 +466,71 @@ func (s *Exec) Run() (err error) {
 	for {
 		select {
 		case err := <-stdout_reader_done:
-			s.Debug().Err(err).Msg("stdout reader done")
+			w.Debug().Err(err).Msg("stdout reader done")
 			if err == nil {
 				if stdout_ok {
+					stdout_reader_done = nil
 					continue // it's fine
 				} else {
 					err = io.EOF // it shouldn't end
 				}
 			}
-			return fmt.Errorf("stdout closed: %w", err)
+			return fmt.Errorf("stdout closed: %w", err), nil
 		case err := <-stdin_writer_done:
-			s.Debug().Err(err).Msg("stdin writer done")
+			w.Debug().Err(err).Msg("stdin writer done")
 			if err != nil && stdin_ok {
 				stdin_writer_done = nil // continue, ignore stdin
 				continue
 			}
-			return fmt.Errorf("stdin closed: %w", err)
+			if err == nil {
+				err = io.EOF
+			}
+			return fmt.Errorf("stdin closed: %w", err), nil
 		case err := <-stderr_reader_done:
-			s.Debug().Err(err).Msg("stderr reader done")
+			w.Debug().Err(err).Msg("stderr reader done")
 			stderr_reader_done = nil // continue, ignore stderr
 		case <-s.Ctx.Done():
 			err := context.Cause(s.Ctx)
-			s.Debug().Err(err).Msg("context cancel")
-			return err
+			w.Debug().Err(err).Msg("context cancel")
+			return err, nil
 		}
 	}
 }
 
-func (s *Exec) stdoutReader(done chan error) {
-	done <- s.eio.ReadStream(s.cmd_out, nil)
+func (w *execWorker) stdoutReader(done chan error) {
+	s := w.s
+	switch {
+	case s.opt_verdict:
+		done <- w.verdictReader()
+	case s.reorder != nil:
+		done <- s.eio.ReadStreamSingle(w.cmd_out, nil, func(m *msg.Msg) error {
+			return s.reorder.output(m, w.id)
+		})
+	case len(s.workers) > 1:
+		done <- s.eio.ReadStreamSingle(w.cmd_out, nil, nil)
+	default:
+		done <- s.eio.ReadStream(w.cmd_out, nil)
+	}
 	close(done)
 }
 
-func (s *Exec) stderrReader(done chan error) {
-	in := bufio.NewScanner(s.cmd_err)
+func (w *execWorker) stderrReader(done chan error) {
+	in := bufio.NewScanner(w.cmd_err)
 	for in.Scan() {
-		s.Info().Msg(in.Text())
+		w.Info().Msg(in.Text())
 	}
 	done <- in.Err()
 	close(done)
 }
 
-func (s *Exec) stdinWriter(done chan error) {
-	done <- s.eio.WriteStream(s.cmd_in)
-	s.cmd_in.Close()
+func (w *execWorker) stdinWriter(done chan error, stop chan struct{}) {
+	var err error
+	if w.s.opt_restart == "no" && len(w.s.workers) == 1 {
+		err = w.s.eio.WriteStream(w.cmd_in)
+	} else {
+		err = w.s.eio.WriteStreamUntil(w.output, w.cmd_in, stop) // keep the output for the next instance
+	}
+	w.cmd_in.Close()
+	done <- err
 	close(done)
 }
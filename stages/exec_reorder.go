@@ -0,0 +1,180 @@
+package stages
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+)
+
+// execReorder re-injects the output of exec --workers in the original message order.
+//
+// Each worker is assumed to process its messages in FIFO order, so once a worker
+// outputs a message, all messages sent to it earlier are done (possibly dropped).
+// Messages not seen in the output for longer than timeout are assumed dropped.
+// Output is matched to input by message direction and seq, so workers must keep the seq.
+type execReorder struct {
+	sync.Mutex
+
+	eio     *extio.Extio
+	timeout time.Duration
+
+	queue   []*reorderEntry              // dispatched messages, in original order
+	pending [][]*reorderEntry            // per-worker dispatched messages, not done yet
+	entries map[reorderKey]*reorderEntry // queue index
+
+	ready     []*msg.Msg // flushed messages to inject, in order
+	injecting bool       // inject() running?
+}
+
+type reorderKey struct {
+	dir msg.Dir
+	seq int64
+}
+
+type reorderEntry struct {
+	key    reorderKey
+	worker int        // worker index
+	time   time.Time  // when dispatched
+	done   bool       // processed by the worker?
+	msgs   []*msg.Msg // worker output to inject
+}
+
+func newExecReorder(eio *extio.Extio, workers int, timeout time.Duration) *execReorder {
+	return &execReorder{
+		eio:     eio,
+		timeout: timeout,
+		pending: make([][]*reorderEntry, workers),
+		entries: make(map[reorderKey]*reorderEntry),
+	}
+}
+
+// dispatch records m was sent to given worker
+func (r *execReorder) dispatch(m *msg.Msg, worker int) {
+	key := reorderKey{m.Dir, m.Seq}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.entries[key] != nil {
+		return // duplicate?! can't track
+	}
+	e := &reorderEntry{key: key, worker: worker, time: time.Now()}
+	r.queue = append(r.queue, e)
+	r.pending[worker] = append(r.pending[worker], e)
+	r.entries[key] = e
+}
+
+// output handles m read from given worker
+func (r *execReorder) output(m *msg.Msg, worker int) error {
+	r.Lock()
+
+	// not ours, or already flushed? inject now
+	e := r.entries[reorderKey{m.Dir, m.Seq}]
+	if e == nil || e.worker != worker {
+		r.ready = append(r.ready, m)
+		r.Unlock()
+		return r.inject()
+	}
+	e.msgs = append(e.msgs, m)
+
+	// all messages up to e are done for this worker
+	pending := r.pending[worker]
+	for len(pending) > 0 {
+		pe := pending[0]
+		pe.done = true
+		pending = pending[1:]
+		if pe == e {
+			break
+		}
+	}
+	r.pending[worker] = pending
+
+	r.flush(time.Time{})
+	r.Unlock()
+	return r.inject()
+}
+
+// flushWorker marks all messages pending for given worker as done, eg. when it exits
+func (r *execReorder) flushWorker(worker int) {
+	r.Lock()
+	for _, e := range r.pending[worker] {
+		e.done = true
+	}
+	r.pending[worker] = nil
+	r.flush(time.Time{})
+	r.Unlock()
+	r.inject()
+}
+
+// flush moves the output of all done messages at the head of the queue to r.ready.
+// If expired is set, messages dispatched before it are considered done.
+// Must be called with r locked; call inject() after unlocking.
+func (r *execReorder) flush(expired time.Time) {
+	for len(r.queue) > 0 {
+		e := r.queue[0]
+		if !e.done {
+			if !e.time.Before(expired) {
+				break // wait
+			}
+
+			// expired: as it's the oldest message, it must be the first pending
+			e.done = true
+			if p := r.pending[e.worker]; len(p) > 0 && p[0] == e {
+				r.pending[e.worker] = p[1:]
+			}
+		}
+
+		r.queue[0] = nil
+		r.queue = r.queue[1:]
+		delete(r.entries, e.key)
+		r.ready = append(r.ready, e.msgs...)
+	}
+}
+
+// inject writes r.ready to the pipe, in order, without holding the lock while
+// WriteInput blocks. If inject() is already running elsewhere, it returns
+// immediately, leaving r.ready to the other call.
+func (r *execReorder) inject() (err error) {
+	r.Lock()
+	if r.injecting {
+		r.Unlock()
+		return nil
+	}
+	r.injecting = true
+	for len(r.ready) > 0 {
+		ready := r.ready
+		r.ready = nil
+		r.Unlock()
+
+		for _, m := range ready {
+			if werr := r.eio.WriteInput(m); werr != nil {
+				err = werr
+			}
+		}
+
+		r.Lock()
+	}
+	r.injecting = false
+	r.Unlock()
+	return err
+}
+
+// expire periodically flushes messages older than r.timeout, until ctx is done
+func (r *execReorder) expire(ctx context.Context) {
+	ticker := time.NewTicker(max(r.timeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.Lock()
+			r.flush(now.Add(-r.timeout))
+			r.Unlock()
+			r.inject()
+		}
+	}
+}
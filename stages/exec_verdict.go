@@ -0,0 +1,150 @@
+package stages
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+// In the --verdict mode, each message is sent to the process as a JSON object
+// with a unique id, eg. {"id":1,"msg":[...]}, and bgpipe waits for the process
+// to print its verdict for that id, one of:
+//
+//	{"id":1,"verdict":"accept"}              // pass the message as-is
+//	{"id":1,"verdict":"drop"}                // drop the message
+//	{"id":1,"verdict":"replace","msg":[...]} // replace the message
+//
+// If no verdict arrives in --verdict-timeout, --verdict-fail decides.
+// With --verdict-inject, the process may also print new messages in the usual
+// JSON format; otherwise any line that is not a verdict is a protocol error.
+
+// execVerdict is the process verdict for a message
+type execVerdict struct {
+	Id      uint64          `json:"id"`
+	Verdict string          `json:"verdict"`
+	Msg     json.RawMessage `json:"msg,omitempty"`
+}
+
+// verdictMsg sends m to the process and waits for its verdict
+func (s *Exec) verdictMsg(m *msg.Msg) bool {
+	// process down? (--fail-open)
+	if s.eio.Bypass.Load() {
+		return true
+	}
+
+	// request
+	id := s.vid.Add(1)
+	bb := s.eio.Pool.Get()
+	bb.B = append(bb.B, `{"id":`...)
+	bb.B = strconv.AppendUint(bb.B, id, 10)
+	bb.B = append(bb.B, `,"msg":`...)
+	bb.B = append(bb.B, bytes.TrimSpace(m.GetJSON())...)
+	bb.B = append(bb.B, "}\n"...)
+
+	// send and wait, both within --verdict-timeout
+	ch := make(chan *execVerdict, 1)
+	s.verdicts.Store(id, ch)
+	defer s.verdicts.Delete(id)
+	timer := time.NewTimer(s.opt_vtimeout)
+	defer timer.Stop()
+
+	sent, timeout := func() (sent, timeout bool) {
+		defer func() { recover() }() // closed output
+		select {
+		case s.eio.Output <- bb:
+			return true, false
+		case <-timer.C:
+			return false, true
+		case <-s.Ctx.Done():
+			return false, false
+		}
+	}()
+	if !sent {
+		s.eio.Pool.Put(bb)
+		if timeout {
+			s.Event("timeout", id)
+		}
+		return s.opt_vfail == "open"
+	}
+
+	select {
+	case v := <-ch:
+		switch v.Verdict {
+		case "accept":
+			return true
+		case "drop":
+			return false
+		default: // replace
+			if err := s.eio.ReadSingleStrict("", v.Msg, nil); err != nil { // NB: not --pardon
+				s.Warn().Err(err).Uint64("id", id).Msg("invalid replacement message")
+				return s.opt_vfail == "open"
+			}
+			return false
+		}
+	case <-timer.C:
+		s.Event("timeout", id)
+		return s.opt_vfail == "open"
+	case <-s.Ctx.Done():
+		return s.opt_vfail == "open"
+	}
+}
+
+// verdictReader reads verdicts (and new messages) from the process stdout
+func (w *execWorker) verdictReader() error {
+	s := w.s
+	in := bufio.NewScanner(w.cmd_out)
+	in.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for in.Scan() {
+		line := bytes.TrimSpace(in.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// a new message?
+		isv := line[0] == '{' && bytes.Contains(line, []byte(`"verdict"`))
+		if !isv && s.opt_vinject {
+			if err := s.eio.ReadSingle(line, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// parse
+		v := new(execVerdict)
+		err := fmt.Errorf("not a verdict, see --verdict-inject")
+		if isv {
+			err = json.Unmarshal(line, v)
+		}
+		switch {
+		case err != nil:
+		case v.Verdict == "replace" && len(v.Msg) == 0:
+			err = fmt.Errorf("id %d: replace without msg", v.Id)
+		case v.Verdict != "accept" && v.Verdict != "drop" && v.Verdict != "replace":
+			err = fmt.Errorf("id %d: invalid verdict: %s", v.Id, v.Verdict)
+		}
+		if err != nil {
+			if s.K.Bool("pardon") {
+				w.Warn().Err(err).Bytes("input", line).Msg("invalid verdict")
+				continue
+			}
+			return fmt.Errorf("invalid verdict: %w", err)
+		}
+
+		// deliver
+		ch, ok := s.verdicts.Load(v.Id)
+		if ok {
+			select {
+			case ch <- v:
+				continue
+			default: // duplicate
+			}
+		}
+		w.Debug().Uint64("id", v.Id).Msg("late, unknown, or duplicate verdict")
+	}
+	return in.Err()
+}
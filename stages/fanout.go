@@ -0,0 +1,109 @@
+package stages
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+	"github.com/valyala/bytebufferpool"
+)
+
+// fanout routes the output of a server stage to its clients, queueing
+// a copy of each message for every client that wants it.
+type fanout struct {
+	eio     *extio.Extio
+	mu      sync.RWMutex            // guards clients
+	clients map[*fanClient]struct{} // current clients
+}
+
+// fanClient is a fanout client
+type fanClient struct {
+	out   chan *bytebufferpool.ByteBuffer // output queue
+	match func(m *msg.Msg) bool           // message filter (nil means all)
+}
+
+// attach makes fo the router of eio, before eio.Attach,
+// which then defaults --overflow to drop-oldest
+func (fo *fanout) attach(eio *extio.Extio) {
+	fo.eio = eio
+	fo.clients = make(map[*fanClient]struct{})
+	eio.Router = fo.route
+}
+
+// add registers a new client with given message filter, which may be nil
+func (fo *fanout) add(match func(m *msg.Msg) bool) *fanClient {
+	fc := &fanClient{
+		out:   make(chan *bytebufferpool.ByteBuffer, cap(fo.eio.Output)),
+		match: match,
+	}
+	fo.mu.Lock()
+	fo.clients[fc] = struct{}{}
+	fo.mu.Unlock()
+	return fc
+}
+
+// remove closes the queue of fc, unregisters it, and drops what is left in the queue.
+// Safe to call more than once, eg. both from the client reader and writer.
+func (fo *fanout) remove(fc *fanClient) {
+	// NB: close first, which unblocks fo.route if needed
+	close_safe(fc.out)
+	fo.mu.Lock()
+	delete(fo.clients, fc)
+	fo.mu.Unlock()
+	for bb := range fc.out {
+		fo.eio.Put(bb)
+	}
+}
+
+// route queues bb to all clients that want m (all clients if m is nil)
+func (fo *fanout) route(m *msg.Msg, bb *bytebufferpool.ByteBuffer) bool {
+	fo.mu.RLock()
+	defer fo.mu.RUnlock()
+
+	// queue a copy of bb for all but the last match, which takes bb
+	var last *fanClient
+	for fc := range fo.clients {
+		if m != nil && fc.match != nil && !fc.match(m) {
+			continue
+		}
+		if last != nil {
+			cp := fo.eio.Pool.Get()
+			cp.B = append(cp.B, bb.B...)
+			fo.eio.Queue(last.out, cp)
+		}
+		last = fc
+	}
+	if last != nil {
+		fo.eio.Queue(last.out, bb)
+	} else {
+		fo.eio.Put(bb)
+	}
+
+	return true
+}
+
+// run waits until the stage output is closed (returning nil) or ctx is done,
+// and closes all client queues on exit, letting the writers finish.
+func (fo *fanout) run(ctx context.Context) error {
+	defer func() {
+		fo.mu.Lock()
+		for fc := range fo.clients {
+			close_safe(fc.out)
+		}
+		fo.mu.Unlock()
+	}()
+
+	// NB: fo.route bypasses the output
+	for {
+		select {
+		case bb, ok := <-fo.eio.Output:
+			if !ok {
+				return nil
+			}
+			fo.eio.Put(bb)
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
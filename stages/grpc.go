@@ -0,0 +1,330 @@
+package stages
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Grpc serves the bgpipe.Bgpipe gRPC service (see bgpipe.proto), streaming
+// the messages to clients and injecting the messages they send back.
+// Clients can select a subset of messages using extio.Filter query in metadata.
+type Grpc struct {
+	*core.StageBase
+
+	addr      string        // listen address
+	keepalive time.Duration // --keepalive
+	auth      authConfig    // TLS and metadata auth
+	srv       *grpc.Server  // gRPC server
+
+	fan fanout // output to clients
+	eio *extio.Extio
+}
+
+// grpcClient is a gRPC streaming client
+type grpcClient struct {
+	*fanClient
+	remote string        // remote address
+	write  bool          // read-write role?
+	sub    *extio.Filter // subscription (nil means all messages)
+}
+
+// grpcService describes the bgpipe.Bgpipe service, without generated code
+var grpcService = grpc.ServiceDesc{
+	ServiceName: "bgpipe.Bgpipe",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Stream",
+		Handler: func(srv any, ss grpc.ServerStream) error {
+			return srv.(*Grpc).stream(ss)
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+	Metadata: "bgpipe.proto",
+}
+
+// grpcCodec passes Protobuf messages through as bytes, as extio does the encoding
+type grpcCodec struct{}
+
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	buf, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("invalid message type: %T", v)
+	}
+	return bytes.Clone(buf), nil // NB: gRPC may write it later
+}
+
+func (grpcCodec) Unmarshal(data []byte, v any) error {
+	buf, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("invalid message type: %T", v)
+	}
+	*buf = append((*buf)[:0], data...)
+	return nil
+}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+func NewGrpc(parent *core.StageBase) core.Stage {
+	s := &Grpc{StageBase: parent}
+	s.auth.StageBase = parent
+
+	o := &s.Options
+	o.Descr = "filter messages over a gRPC stream (see bgpipe.proto)"
+	o.IsProducer = true
+	o.Bidir = true
+
+	f := o.Flags
+	f.Bool("tls", false, "use TLS")
+	addAuthFlags(f)
+	f.Duration("keepalive", 30*time.Second, "ping idle clients at this interval (0 means gRPC default)")
+	o.Args = []string{"addr"}
+
+	o.Events = map[string]string{
+		"connected":    "client connected (value: remote, subscription)",
+		"disconnected": "client disconnected (value: remote, error)",
+		"denied":       "client denied (value: remote, reason)",
+	}
+
+	s.eio = extio.NewExtio(parent, 0)
+
+	// Protobuf is the only format
+	if fl := f.Lookup("proto"); fl != nil {
+		fl.DefValue = "true"
+		fl.Value.Set(fl.DefValue)
+	}
+
+	return s
+}
+
+func (s *Grpc) Attach() error {
+	k := s.K
+
+	// options
+	s.addr = k.String("addr")
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		return fmt.Errorf("listen address: %w", err)
+	}
+	s.keepalive = k.Duration("keepalive")
+	if s.keepalive < 0 {
+		return fmt.Errorf("--keepalive: must not be negative")
+	}
+
+	// TLS config and auth
+	if err := s.auth.attach(k.Bool("tls"), true); err != nil {
+		return err
+	}
+	if s.auth.tls != nil {
+		s.auth.tls.NextProtos = []string{"h2"}
+	}
+
+	// Protobuf only
+	if !k.Bool("proto") {
+		return fmt.Errorf("--proto: required over gRPC")
+	}
+	for _, v := range []string{"raw", "mrt", "pcap", "csv", "bgpdump", "pretty"} {
+		if k.Bool(v) {
+			return fmt.Errorf("--%s: not supported over gRPC", v)
+		}
+	}
+
+	// route output to the clients
+	s.fan.attach(s.eio)
+	return s.eio.Attach()
+}
+
+func (s *Grpc) Prepare() error {
+	opts := []grpc.ServerOption{
+		grpc.ForceServerCodec(grpcCodec{}),
+	}
+	if s.auth.tls != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.auth.tls)))
+	}
+	if s.keepalive > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time: s.keepalive,
+		}))
+	}
+	s.srv = grpc.NewServer(opts...)
+	s.srv.RegisterService(&grpcService, s)
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(s.Ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	s.Info().Bool("tls", s.auth.tls != nil).Msgf("listening on %s", ln.Addr())
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != grpc.ErrServerStopped {
+			s.Cancel(fmt.Errorf("listen error: %w", err))
+		}
+	}()
+
+	return nil
+}
+
+func (s *Grpc) Run() error {
+	return s.fan.run(s.Ctx)
+}
+
+func (s *Grpc) Stop() error {
+	if s.srv != nil {
+		s.srv.Stop()
+	}
+	s.eio.InputClose()
+	s.eio.OutputClose()
+	return nil
+}
+
+// check checks if a new client stream is allowed, returning the client if so
+func (s *Grpc) check(ctx context.Context) (*grpcClient, error) {
+	c := &grpcClient{remote: "unknown", write: true}
+	if p, ok := peer.FromContext(ctx); ok {
+		c.remote = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	// client IP allowed?
+	if err := s.auth.connCheck(c.remote); err != nil {
+		s.Warn().Msgf("%s: client IP not allowed", c.remote)
+		s.Event("denied", c.remote, "ip")
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	// authorized?
+	if reason := s.auth.serverAuth(get("authorization")); reason != "" {
+		s.Warn().Msgf("%s: unauthorized: %s", c.remote, reason)
+		s.Event("denied", c.remote, reason)
+		return nil, status.Error(codes.Unauthenticated, reason)
+	}
+
+	// subscription and role
+	q, err := url.ParseQuery(get("bgpipe-subscribe"))
+	if err == nil {
+		c.sub, err = extio.ParseFilter(q)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid subscription: %v", err)
+	}
+	switch v := get("bgpipe-role"); v {
+	case "", "rw":
+		break // default
+	case "read":
+		c.write = false
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid role: %s", v)
+	}
+
+	return c, nil
+}
+
+// stream serves a new client stream
+func (s *Grpc) stream(ss grpc.ServerStream) error {
+	ctx := ss.Context()
+	c, err := s.check(ctx)
+	if err != nil {
+		return err
+	}
+
+	// register the client
+	c.fanClient = s.fan.add(c.sub.Match)
+	md, _ := metadata.FromIncomingContext(ctx)
+	sub := strings.Join(md.Get("bgpipe-subscribe"), "&")
+	s.Info().Bool("write", c.write).Msgf("%s: new client", c.remote)
+	s.Event("connected", c.remote, sub)
+
+	// read in background, write until error
+	reader_done := make(chan error, 1)
+	go func() {
+		reader_done <- s.recv(ss, c)
+	}()
+	err = s.send(ss, c, reader_done)
+	s.Info().Err(err).Msgf("%s: client finished", c.remote)
+	s.Event("disconnected", c.remote, err)
+
+	// unregister
+	s.fan.remove(c.fanClient)
+	return err
+}
+
+// send writes the output queue of c to ss, until error or reader error
+func (s *Grpc) send(ss grpc.ServerStream, c *grpcClient, reader_done chan error) error {
+	ctx := ss.Context()
+	for {
+		select {
+		case bb, ok := <-c.out:
+			if !ok {
+				return nil
+			}
+			_, n := protowire.ConsumeVarint(bb.B) // skip the length
+			err := ss.SendMsg(bb.B[max(n, 0):])
+			s.eio.Put(bb)
+			if err != nil {
+				return err
+			}
+		case err := <-reader_done:
+			if err != io.EOF {
+				return err
+			}
+			reader_done = nil // client done sending, but may still receive
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// recv injects the messages sent by client c, until error
+func (s *Grpc) recv(ss grpc.ServerStream, c *grpcClient) error {
+	// tag incoming messages with the remote
+	cb := func(m *msg.Msg) bool {
+		pipe.MsgTags(m)["grpc/remote"] = c.remote
+		return true
+	}
+
+	var buf, input []byte
+	for {
+		if err := ss.RecvMsg(&buf); err != nil {
+			return err
+		}
+
+		// read-only client?
+		if !c.write {
+			continue
+		}
+
+		// extio expects the length first
+		input = protowire.AppendVarint(input[:0], uint64(len(buf)))
+		input = append(input, buf...)
+		if err := s.eio.ReadSingleFrom(c.remote, input, cb); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid message: %v", err)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package stages
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+)
+
+// Http serves the message stream to HTTP clients, as Server-Sent Events or NDJSON.
+// Clients can select a subset of messages using extio.Filter query parameters,
+// eg. GET /?type=UPDATE&prefix=10.0.0.0/8&format=sse
+//
+// Clients can also inject messages using POST, with a single JSON message
+// (Content-Type: application/json) or a batch of messages (NDJSON) in the body.
+// The response lists the result for each message.
+type Http struct {
+	*core.StageBase
+
+	url       url.URL       // listen URL
+	timeout   time.Duration // --timeout
+	keepalive time.Duration // --keepalive
+	maxBody   int64         // --max-body
+	auth      authConfig    // TLS and HTTP auth
+	srv       *http.Server  // http server
+
+	fan fanout // output to clients
+	eio *extio.Extio
+}
+
+// httpClient is an HTTP streaming client
+type httpClient struct {
+	*fanClient
+	remote string        // remote address
+	sub    *extio.Filter // subscription (nil means all messages)
+}
+
+func NewHttp(parent *core.StageBase) core.Stage {
+	s := &Http{StageBase: parent}
+	s.auth.StageBase = parent
+
+	o := &s.Options
+	o.Descr = "stream messages over HTTP (SSE, NDJSON, or POST)"
+	o.IsProducer = true
+	o.Bidir = true
+
+	f := o.Flags
+	f.Duration("timeout", 10*time.Second, "HTTP header read timeout")
+	f.Duration("keepalive", 15*time.Second, "send SSE comments at this interval (0 means never)")
+	f.Int64("max-body", 1024*1024, "maximum POST body size (bytes)")
+	addAuthFlags(f)
+	o.Args = []string{"url"}
+
+	o.Events = map[string]string{
+		"connected":    "client connected (value: remote, query)",
+		"disconnected": "client disconnected (value: remote)",
+		"denied":       "client denied (value: remote, reason)",
+	}
+
+	s.eio = extio.NewExtio(parent, extio.MODE_COPY)
+
+	return s
+}
+
+func (s *Http) Attach() error {
+	k := s.K
+
+	// options
+	s.timeout = k.Duration("timeout")
+	s.keepalive = k.Duration("keepalive")
+	if s.timeout < 0 || s.keepalive < 0 {
+		return fmt.Errorf("--timeout and --keepalive: must not be negative")
+	}
+	s.maxBody = k.Int64("max-body")
+	if s.maxBody < 1 {
+		return fmt.Errorf("--max-body: must be positive")
+	}
+
+	// check URL
+	url, err := url.Parse(k.String("url"))
+	if err != nil {
+		return fmt.Errorf("listen URL: %w", err)
+	}
+	switch url.Scheme {
+	case "http", "https":
+		break // ok
+	case "":
+		return fmt.Errorf("listen URL: needs 'http://' or 'https://' scheme prefix")
+	default:
+		return fmt.Errorf("listen URL: invalid scheme: %s", url.Scheme)
+	}
+	if url.Path == "" {
+		url.Path = "/"
+	}
+	s.url = *url
+
+	// SSL config and auth
+	if err := s.auth.attach(s.url.Scheme == "https", true); err != nil {
+		return err
+	}
+
+	// text formats only
+	for _, v := range []string{"raw", "mrt", "pcap", "proto"} {
+		if k.Bool(v) {
+			return fmt.Errorf("--%s: not supported over HTTP streams", v)
+		}
+	}
+
+	// route output to the clients
+	s.fan.attach(s.eio)
+	return s.eio.Attach()
+}
+
+func (s *Http) Prepare() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.url.Path, s.handle)
+
+	s.srv = &http.Server{
+		Handler:           mux,
+		Addr:              s.url.Host,
+		BaseContext:       func(l net.Listener) context.Context { return s.Ctx },
+		TLSConfig:         s.auth.tls,
+		ReadHeaderTimeout: s.timeout,
+	}
+
+	s.Info().Msgf("listening on %s", s.url.String())
+	go func() {
+		var err error
+		if s.url.Scheme == "https" {
+			err = s.srv.ListenAndServeTLS("", "") // will use srv.TLSConfig
+		} else {
+			err = s.srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			s.Cancel(fmt.Errorf("listen error: %w", err))
+		}
+	}()
+
+	return nil
+}
+
+func (s *Http) Run() error {
+	return s.fan.run(s.Ctx)
+}
+
+func (s *Http) Stop() error {
+	if s.srv != nil {
+		s.srv.Close()
+	}
+	s.eio.OutputClose()
+	return nil
+}
+
+// handle serves a new HTTP client
+func (s *Http) handle(w http.ResponseWriter, r *http.Request) {
+	if !s.auth.serverCheck(w, r) {
+		return
+	}
+
+	// check method
+	read, write := s.K.Bool("read"), s.K.Bool("write")
+	switch {
+	case r.Method == http.MethodGet && !read:
+		break // stream
+	case r.Method == http.MethodPost && !write:
+		s.handlePost(w, r)
+		return
+	default:
+		switch {
+		case read:
+			w.Header().Set("Allow", "POST")
+		case write:
+			w.Header().Set("Allow", "GET")
+		default:
+			w.Header().Set("Allow", "GET, POST")
+		}
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// subscription
+	q := r.URL.Query()
+	sub, err := extio.ParseFilter(q)
+	if err != nil {
+		http.Error(w, "Invalid subscription: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// output format
+	var sse bool
+	switch q.Get("format") {
+	case "sse":
+		sse = true
+	case "ndjson":
+		sse = false
+	case "":
+		sse = strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	default:
+		http.Error(w, "Invalid format: "+q.Get("format"), http.StatusBadRequest)
+		return
+	}
+
+	// register the client
+	c := &httpClient{
+		fanClient: s.fan.add(sub.Match),
+		remote:    r.RemoteAddr,
+		sub:       sub,
+	}
+	s.Info().Bool("sse", sse).Msgf("%s: new client", c.remote)
+	s.Event("connected", c.remote, r.URL.RawQuery)
+
+	// stream until error
+	err = s.stream(w, r, c, sse)
+	s.Info().Err(err).Msgf("%s: client finished", c.remote)
+	s.Event("disconnected", c.remote)
+
+	// unregister
+	s.fan.remove(c.fanClient)
+}
+
+// stream writes the output queue of c to w
+func (s *Http) stream(w http.ResponseWriter, r *http.Request, c *httpClient, sse bool) error {
+	rc := http.NewResponseController(w)
+
+	// headers
+	h := w.Header()
+	switch {
+	case sse:
+		h.Set("Content-Type", "text/event-stream")
+	case s.K.Bool("csv") || s.K.Bool("bgpdump") || s.K.Bool("pretty"):
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		h.Set("Content-Type", "application/x-ndjson")
+	}
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+
+	// SSE keepalives?
+	var tick <-chan time.Time
+	if sse && s.keepalive > 0 {
+		ticker := time.NewTicker(s.keepalive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var err error
+	for {
+		select {
+		case bb, ok := <-c.out:
+			if !ok {
+				return io.EOF
+			}
+			if sse {
+				err = writeSSE(w, bb.B)
+			} else {
+				_, err = w.Write(bb.B)
+			}
+			s.eio.Put(bb)
+
+			// flush only if nothing more to write now
+			if err == nil && len(c.out) == 0 {
+				err = rc.Flush()
+			}
+		case <-tick:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+		case <-r.Context().Done():
+			return context.Cause(r.Context())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeSSE writes buf as a Server-Sent Event to w, one data field per line
+func writeSSE(w io.Writer, buf []byte) error {
+	var out []byte
+	for _, line := range bytes.Split(bytes.TrimRight(buf, "\r\n"), []byte{'\n'}) {
+		out = append(out, "data: "...)
+		out = append(out, bytes.TrimRight(line, "\r")...)
+		out = append(out, '\n')
+	}
+	out = append(out, '\n')
+	_, err := w.Write(out)
+	return err
+}
+
+// httpResult is the result of a message POSTed by a client
+type httpResult struct {
+	Line   int    `json:"line"`            // line number in the request body
+	Status string `json:"status"`          // ok, skipped, or error
+	Error  string `json:"error,omitempty"` // parse error
+}
+
+// handlePost injects the messages in a POST request body, and writes the results
+func (s *Http) handlePost(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBody))
+	if err != nil {
+		http.Error(w, "Could not read body: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// single message or NDJSON?
+	var lines [][]byte
+	if ct, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(ct) == "application/json" {
+		lines = [][]byte{body}
+	} else {
+		lines = bytes.Split(body, []byte{'\n'})
+	}
+
+	// tag messages with the remote
+	var accepted bool
+	cb := func(m *msg.Msg) bool {
+		pipe.MsgTags(m)["http/remote"] = r.RemoteAddr
+		accepted = true
+		return true
+	}
+
+	// inject
+	var ret struct {
+		Accepted int          `json:"accepted"`
+		Skipped  int          `json:"skipped"`
+		Errors   int          `json:"errors"`
+		Results  []httpResult `json:"results"`
+	}
+	for i, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		res := httpResult{Line: i + 1}
+		accepted = false
+		if err := s.eio.ReadSingleStrict(r.RemoteAddr, line, cb); err != nil { // NB: even with --pardon
+			res.Status, res.Error = "error", err.Error()
+			ret.Errors++
+		} else if accepted {
+			res.Status = "ok"
+			ret.Accepted++
+		} else {
+			res.Status = "skipped"
+			ret.Skipped++
+		}
+		ret.Results = append(ret.Results, res)
+	}
+	s.Debug().Msgf("%s: POST accepted=%d skipped=%d errors=%d",
+		r.RemoteAddr, ret.Accepted, ret.Skipped, ret.Errors)
+
+	// respond (NB: 400 only if nothing was injected, so clients retrying on 4xx do not duplicate)
+	w.Header().Set("Content-Type", "application/json")
+	if ret.Errors > 0 && ret.Accepted == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(&ret)
+}
@@ -1,6 +1,8 @@
 package stages
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"runtime"
@@ -15,6 +17,8 @@ type Listen struct {
 	in *pipe.Input
 
 	bind string
+	tcp  tcpConfig  // socket options
+	auth authConfig // --tls config and --allow
 	conn net.Conn
 }
 
@@ -24,11 +28,17 @@ func NewListen(parent *core.StageBase) core.Stage {
 		o = &s.Options
 		f = o.Flags
 	)
+	s.tcp.StageBase = parent
+	s.auth.StageBase = parent
 
 	f.Duration("timeout", 0, "connect timeout (0 means none)")
 	if runtime.GOOS == "linux" {
 		f.String("md5", "", "TCP MD5 password")
+		addAoFlags(f)
 	}
+	addTcpFlags(f)
+	f.Bool("tls", false, "accept TLS connections")
+	addTLSFlags(f)
 	o.Args = []string{"addr"}
 
 	o.Descr = "wait for a BGP client to connect over TCP"
@@ -51,14 +61,26 @@ func (s *Listen) Attach() error {
 		s.bind += ":179" // best-effort try
 	}
 
+	// socket options
+	if err := s.tcp.attach(); err != nil {
+		return err
+	}
+
+	// TLS config and client IP allowlist
+	if err := s.auth.attach(s.K.Bool("tls"), true); err != nil {
+		return err
+	}
+
 	s.in = s.P.AddInput(s.Dir)
 	return nil
 }
 
 func (s *Listen) Prepare() error {
 	// listen
-	var lc net.ListenConfig
-	lc.Control = tcp_md5(s.K.String("md5"))
+	lc := net.ListenConfig{
+		Control:   s.tcp.control(),
+		KeepAlive: s.tcp.keepalive,
+	}
 	l, err := lc.Listen(s.Ctx, "tcp", s.bind)
 	if err != nil {
 		return err
@@ -73,19 +95,48 @@ func (s *Listen) Prepare() error {
 		}
 	}
 
-	// wait for first connection
+	// wait for first valid connection
 	s.Info().Msgf("listening on %s", l.Addr())
-	conn, err := l.Accept()
-	if err != nil {
-		return err
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		conn, err = s.check(conn)
+		if err != nil {
+			s.Warn().Err(err).Msgf("%s: client rejected", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		// don't listen for more
+		l.Close()
+
+		// success
+		s.conn = conn
+		return nil
 	}
+}
 
-	// don't listen for more
-	l.Close()
+// check checks if new conn is allowed, doing the TLS handshake if needed
+func (s *Listen) check(conn net.Conn) (net.Conn, error) {
+	if err := s.auth.connCheck(conn.RemoteAddr().String()); err != nil {
+		return conn, err
+	} else if s.auth.tls == nil {
+		return conn, nil
+	}
 
-	// success
-	s.conn = conn
-	return nil
+	ctx, cancel := context.WithTimeout(s.Ctx, 10*time.Second)
+	defer cancel()
+	tc := tls.Server(conn, s.auth.tls)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return conn, fmt.Errorf("TLS handshake: %w", err)
+	}
+
+	s.Info().Str("tls", tls.VersionName(tc.ConnectionState().Version)).
+		Msgf("%s: TLS client accepted", conn.RemoteAddr())
+	return tc, nil
 }
 
 func (s *Listen) Run() error {
@@ -41,6 +41,7 @@ func (s *Pipe) Attach() error {
 	}
 	s.fpath = filepath.Clean(s.fpath)
 	s.flag = os.O_RDWR
+	s.eio.Source = s.fpath
 
 	return s.eio.Attach()
 }
@@ -0,0 +1,274 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+	"github.com/quic-go/quic-go"
+)
+
+// Quic exchanges messages over a QUIC connection (TLS 1.3), as a client or a server,
+// eg. to carry a BGP session between two bgpipe instances over lossy links.
+// Each side sends its messages on its own unidirectional stream.
+type Quic struct {
+	*core.StageBase
+	sf   sockFlow   // message flow
+	auth authConfig // TLS config and client IP allowlist
+
+	addr string       // remote or listen address
+	conf *quic.Config // QUIC config
+
+	eio *extio.Extio
+}
+
+// quicALPN is the TLS application protocol of the quic stage
+const quicALPN = "bgpipe"
+
+// quicLinger is how long quicConn.Close waits for the remote to finish too
+const quicLinger = time.Second
+
+func NewQuic(parent *core.StageBase) core.Stage {
+	s := &Quic{StageBase: parent}
+	s.auth.StageBase = parent
+
+	o := &s.Options
+	o.Descr = "filter messages over a QUIC connection"
+	o.IsProducer = true
+	o.Bidir = true
+
+	f := o.Flags
+	f.Bool("listen", false, "listen on given address instead of connecting to it")
+	addTLSFlags(f)
+	f.Duration("timeout", 10*time.Second, "connect and TLS handshake timeout")
+	f.Duration("keepalive", 15*time.Second, "send keepalives at this interval (0 means never)")
+	f.Duration("idle-timeout", 30*time.Second, "close the connection after this long without network activity")
+	addSockFlags(f)
+	o.Args = []string{"addr"}
+
+	o.Events = map[string]string{
+		"connected":    "connection established (value: remote)",
+		"disconnected": "connection closed (value: remote, error)",
+		"denied":       "server client denied (value: remote, reason)",
+	}
+
+	s.eio = extio.NewExtio(parent, 0)
+	s.sf = sockFlow{
+		StageBase: parent,
+		eio:       s.eio,
+		tag:       "quic/remote",
+		dial:      s.dial,
+		accept:    s.accept,
+	}
+	return s
+}
+
+func (s *Quic) Attach() error {
+	k := s.K
+
+	// address
+	s.addr = k.String("addr")
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	s.eio.Source = s.addr
+	s.sf.addr = s.addr
+
+	// QUIC config
+	s.conf = &quic.Config{
+		HandshakeIdleTimeout: k.Duration("timeout"),
+		MaxIdleTimeout:       k.Duration("idle-timeout"),
+		KeepAlivePeriod:      k.Duration("keepalive"),
+	}
+	if s.conf.HandshakeIdleTimeout <= 0 {
+		return fmt.Errorf("--timeout: must be positive")
+	} else if s.conf.MaxIdleTimeout <= 0 {
+		return fmt.Errorf("--idle-timeout: must be positive")
+	} else if s.conf.KeepAlivePeriod < 0 {
+		return fmt.Errorf("--keepalive: must not be negative")
+	}
+
+	// TLS is mandatory
+	if err := s.auth.attach(true, k.Bool("listen")); err != nil {
+		return err
+	}
+	s.auth.tls.NextProtos = []string{quicALPN}
+
+	// formats
+	if k.Bool("pcap") && !k.Bool("write") {
+		return fmt.Errorf("--pcap: requires --write over QUIC")
+	}
+
+	if err := s.sf.attach(k.Bool("listen")); err != nil {
+		return err
+	}
+	return s.eio.Attach()
+}
+
+func (s *Quic) Prepare() error {
+	if !s.K.Bool("listen") {
+		return s.sf.connect()
+	}
+
+	ln, err := quic.ListenAddr(s.addr, s.auth.tls, s.conf)
+	if err != nil {
+		return err
+	}
+
+	s.Info().Msgf("listening on %s", ln.Addr())
+	s.sf.serve(&quicListener{ln}) // closed in Stop()
+	return nil
+}
+
+func (s *Quic) Run() error {
+	return s.sf.run()
+}
+
+func (s *Quic) Stop() error {
+	return s.sf.stop()
+}
+
+// dial connects to the QUIC server
+func (s *Quic) dial() (net.Conn, error) {
+	s.Info().Msgf("connecting to %s", s.addr)
+	conn, err := quic.DialAddr(s.Ctx, s.addr, s.auth.clientTLS(), s.conf)
+	if err != nil {
+		return nil, err
+	}
+	return newQuicConn(conn)
+}
+
+// accept checks a new server conn, opening its send stream
+func (s *Quic) accept(conn net.Conn) (string, error) {
+	qc := conn.(*quicConn)
+	remote := qc.RemoteAddr().String()
+	if err := s.auth.connCheck(remote); err != nil {
+		return remote, err
+	}
+	return remote, qc.open()
+}
+
+// quicListener adapts quic.Listener to net.Listener
+type quicListener struct {
+	ln *quic.Listener
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	conn, err := l.ln.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Connection: conn, eof: make(chan struct{})}, nil
+}
+
+func (l *quicListener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// quicConn adapts a QUIC connection to net.Conn, using one unidirectional
+// stream per direction. The remote stream is accepted on the first Read.
+type quicConn struct {
+	quic.Connection
+
+	send    quic.SendStream    // local stream
+	recv    quic.ReceiveStream // remote stream (may be nil)
+	wmu     sync.Mutex         // guards send writes
+	eof     chan struct{}      // closed on remote stream EOF
+	eofSeen bool               // eof closed? (reader only)
+	once    sync.Once          // for Close
+}
+
+// newQuicConn returns a new quicConn for conn, with its send stream open
+func newQuicConn(conn quic.Connection) (*quicConn, error) {
+	qc := &quicConn{Connection: conn, eof: make(chan struct{})}
+	if err := qc.open(); err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return qc, nil
+}
+
+// open opens the send stream
+func (c *quicConn) open() (err error) {
+	c.send, err = c.OpenUniStream()
+	return err
+}
+
+func (c *quicConn) Read(b []byte) (int, error) {
+	if c.recv == nil {
+		recv, err := c.AcceptUniStream(c.Context())
+		if err != nil {
+			return 0, quicError(err)
+		}
+		c.recv = recv
+	}
+
+	n, err := c.recv.Read(b)
+	if err == io.EOF && !c.eofSeen {
+		c.eofSeen = true
+		close(c.eof)
+	}
+	return n, quicError(err)
+}
+
+func (c *quicConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.send.Write(b)
+}
+
+// Close finishes the send stream, waits a bit for the remote to finish too,
+// and closes the connection.
+func (c *quicConn) Close() error {
+	c.once.Do(func() {
+		if c.send == nil {
+			c.CloseWithError(0, "")
+			return
+		}
+
+		// unblock any writer, but keep what it already wrote
+		c.send.SetWriteDeadline(time.Now())
+		c.wmu.Lock()
+		c.send.Close()
+		c.wmu.Unlock()
+
+		select {
+		case <-c.eof:
+		case <-c.Context().Done():
+		case <-time.After(quicLinger):
+		}
+		c.CloseWithError(0, "")
+	})
+	return nil
+}
+
+func (c *quicConn) SetDeadline(t time.Time) error {
+	return errors.ErrUnsupported
+}
+
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	return errors.ErrUnsupported
+}
+
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	return c.send.SetWriteDeadline(t)
+}
+
+// quicError translates a graceful remote close to io.EOF
+func quicError(err error) error {
+	var ae *quic.ApplicationError
+	if errors.As(err, &ae) && ae.Remote && ae.ErrorCode == 0 {
+		return io.EOF
+	}
+	return err
+}
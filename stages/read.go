@@ -44,6 +44,7 @@ func (s *Read) Attach() error {
 		return errors.New("path must be set")
 	}
 	s.fpath = filepath.Clean(s.fpath)
+	s.eio.Source = s.fpath
 
 	return s.eio.Attach()
 }
@@ -5,13 +5,19 @@ import "github.com/bgpfix/bgpipe/core"
 var Repo = map[string]core.NewStage{
 	"connect":   NewConnect,
 	"exec":      NewExec,
+	"grpc":      NewGrpc,
+	"http":      NewHttp,
 	"limit":     NewLimit,
 	"listen":    NewListen,
 	"pipe":      NewPipe,
+	"quic":      NewQuic,
 	"read":      NewRead,
 	"speaker":   NewSpeaker,
 	"stdin":     NewStdin,
 	"stdout":    NewStdout,
+	"tcp":       NewTcp,
+	"unix":      NewUnix,
+	"webhook":   NewWebhook,
 	"websocket": NewWebsocket,
 	"write":     NewWrite,
 }
@@ -0,0 +1,305 @@
+package stages
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+	"github.com/spf13/pflag"
+	"github.com/valyala/bytebufferpool"
+)
+
+// sockFlow implements the message flow of socket-based stages, either as a client
+// that reconnects if needed, or as a server for any number of conns.
+// Each server conn gets a copy of the output, and all can inject messages.
+type sockFlow struct {
+	*core.StageBase
+	eio *extio.Extio
+
+	addr     string        // remote address in client mode
+	tag      string        // message tag for the remote
+	packet   bool          // one message per packet?
+	retry    bool          // --retry
+	retryMax time.Duration // --retry-max
+
+	dial   func() (net.Conn, error)            // client: connects to addr
+	accept func(conn net.Conn) (string, error) // server: describes new conn, or rejects it
+
+	ln         net.Listener // server listener (may be nil)
+	clientConn net.Conn     // client conn (may be nil)
+	fan        fanout       // output to server conns
+	stopping   atomic.Bool  // Stop() called?
+}
+
+// sockConn is a socket server connection
+type sockConn struct {
+	*fanClient
+	conn   net.Conn
+	remote string // remote description
+}
+
+// addSockFlags adds the sockFlow flags to f
+func addSockFlags(f *pflag.FlagSet) {
+	f.Bool("retry", false, "in client mode, reconnect when the connection fails")
+	f.Duration("retry-max", time.Minute, "maximum delay between reconnects")
+}
+
+// attach configures sf from the stage flags, before eio.Attach
+func (sf *sockFlow) attach(server bool) error {
+	k := sf.K
+	sf.retry = k.Bool("retry")
+	sf.retryMax = k.Duration("retry-max")
+	if sf.retry && sf.retryMax < time.Second {
+		return fmt.Errorf("--retry-max: must be at least 1s")
+	} else if sf.retry && server {
+		return fmt.Errorf("--retry: requires client mode")
+	}
+
+	// route output to the server conns
+	if server {
+		sf.fan.attach(sf.eio)
+	}
+	return nil
+}
+
+// connect dials the client conn, if possible
+func (sf *sockFlow) connect() error {
+	conn, err := sf.dial()
+	if err != nil {
+		if !sf.retry {
+			return err
+		}
+		sf.Warn().Err(err).Msg("could not connect, will retry")
+		return nil
+	}
+
+	sf.Info().Msgf("connected %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
+	sf.Event("connected", sf.addr)
+	sf.clientConn = conn
+	return nil
+}
+
+// serve starts accepting server conns from ln, which will be closed in stop()
+func (sf *sockFlow) serve(ln net.Listener) {
+	sf.ln = ln
+	go sf.serverAccept()
+}
+
+// run runs the data flow, until stopped or error
+func (sf *sockFlow) run() error {
+	if sf.ln == nil {
+		return sf.runClient()
+	}
+	return sf.fan.run(sf.Ctx)
+}
+
+// stop requests run to finish, after flushing the output
+func (sf *sockFlow) stop() error {
+	sf.stopping.Store(true)
+	if sf.ln != nil {
+		sf.ln.Close()
+	}
+	sf.eio.InputClose()
+	sf.eio.OutputClose() // NB: the writers flush their queues first
+	return nil
+}
+
+// serverAccept accepts new server conns, until the listener is closed
+func (sf *sockFlow) serverAccept() {
+	for {
+		conn, err := sf.ln.Accept()
+		if err != nil {
+			if !sf.stopping.Load() {
+				sf.Cancel(fmt.Errorf("accept error: %w", err))
+			}
+			return
+		}
+		go sf.serverHandle(conn)
+	}
+}
+
+// serverHandle serves a new server conn
+func (sf *sockFlow) serverHandle(conn net.Conn) {
+	remote, err := sf.accept(conn)
+	if err != nil {
+		sf.Warn().Err(err).Msgf("%s: client denied", remote)
+		sf.Event("denied", remote, err.Error())
+		conn.Close()
+		return
+	}
+
+	// register the client
+	c := &sockConn{
+		fanClient: sf.fan.add(nil),
+		conn:      conn,
+		remote:    remote,
+	}
+	sf.Info().Msgf("%s: new client", c.remote)
+	sf.Event("connected", c.remote)
+
+	// block on conn reader
+	go sf.serverWriter(c)
+	err = sf.connReader(conn, c.remote)
+	sf.Info().Err(err).Msgf("%s: client finished", c.remote)
+	sf.Event("disconnected", c.remote, err)
+
+	// unregister and close
+	sf.fan.remove(c.fanClient)
+	conn.Close()
+}
+
+// serverWriter writes the output queue of server conn c
+func (sf *sockFlow) serverWriter(c *sockConn) {
+	err := sf.connWriter(c.conn, c.out, nil)
+	if err != nil {
+		sf.Warn().Err(err).Msgf("%s: write error", c.remote)
+	}
+
+	// output closed or write error: close the conn, which will stop connReader
+	c.conn.Close()
+	sf.fan.remove(c.fanClient)
+}
+
+// runClient runs the client data flow, reconnecting if needed
+func (sf *sockFlow) runClient() error {
+	delay := time.Second
+	for {
+		// run the connection
+		if conn := sf.clientConn; conn != nil {
+			started := time.Now()
+			err := sf.clientRun(conn)
+			sf.Event("disconnected", sf.addr, err)
+
+			switch {
+			case sf.stopping.Load():
+				return nil // output flushed
+			case sf.Ctx.Err() != nil:
+				return err
+			case !sf.retry:
+				return err
+			}
+
+			// connection was fine for a while?
+			if time.Since(started) > sf.retryMax {
+				delay = time.Second
+			}
+		}
+
+		// back off
+		sf.Warn().Msgf("reconnecting in %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-sf.Ctx.Done():
+			return context.Cause(sf.Ctx)
+		}
+		delay = min(delay*2, sf.retryMax)
+
+		// re-dial
+		sf.clientConn = nil
+		sf.connect() // NB: with --retry, only logs errors
+	}
+}
+
+// clientRun runs the data flow for given client conn, closing it on return
+func (sf *sockFlow) clientRun(conn net.Conn) error {
+	reader_done := make(chan error, 1)
+	go func() {
+		reader_done <- sf.connReader(conn, sf.addr)
+	}()
+
+	stop := make(chan struct{})
+	writer_done := make(chan error, 1)
+	go func() {
+		writer_done <- sf.connWriter(conn, sf.eio.Output, stop)
+	}()
+
+	// wait for the writer to exit, so that a reconnect starts with a single writer
+	defer func() {
+		close(stop)
+		conn.Close()
+		<-writer_done
+	}()
+
+	select {
+	case err := <-reader_done:
+		sf.Debug().Err(err).Msg("reader done")
+		if err == nil {
+			err = io.EOF
+		}
+		return fmt.Errorf("reader closed: %w", err)
+	case err := <-writer_done:
+		sf.Debug().Err(err).Msg("writer done")
+		writer_done <- err // for the defer
+		if err == nil {
+			err = io.EOF
+		}
+		return fmt.Errorf("writer closed: %w", err)
+	case <-sf.Ctx.Done():
+		return context.Cause(sf.Ctx)
+	}
+}
+
+// connReader reads messages from conn until EOF or error
+func (sf *sockFlow) connReader(conn net.Conn, remote string) error {
+	// tag incoming messages with the remote
+	cb := func(m *msg.Msg) bool {
+		pipe.MsgTags(m)[sf.tag] = remote
+		return true
+	}
+
+	// stream socket: split the byte stream into messages
+	if !sf.packet {
+		return sf.eio.ReadStreamSingleFrom(remote, conn, cb, nil)
+	}
+
+	// packet socket: each packet has one or more messages
+	buf := make([]byte, 1024*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := sf.eio.ReadBatchFrom(remote, buf[:n], cb); err != nil {
+				return err
+			}
+		}
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// connWriter writes messages from ch to conn, until ch is closed, stop is closed, or error
+func (sf *sockFlow) connWriter(conn net.Conn, ch chan *bytebufferpool.ByteBuffer, stop <-chan struct{}) error {
+	// stream socket: write as a file
+	if !sf.packet {
+		return sf.eio.WriteStreamUntil(ch, conn, stop)
+	}
+
+	// packet socket: write each message in a separate packet
+	for {
+		select {
+		case bb, ok := <-ch:
+			if !ok {
+				return nil
+			} else if bb == nil {
+				continue
+			}
+			_, err := conn.Write(bb.B)
+			sf.eio.Put(bb)
+			if err != nil {
+				return err
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
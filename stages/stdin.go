@@ -26,6 +26,7 @@ func NewStdin(parent *core.StageBase) core.Stage {
 }
 
 func (s *Stdin) Attach() error {
+	s.eio.Source = "stdin"
 	return s.eio.Attach()
 }
 
@@ -6,6 +6,7 @@ import (
 
 	"github.com/bgpfix/bgpipe/core"
 	"github.com/bgpfix/bgpipe/pkg/extio"
+	"github.com/mattn/go-isatty"
 )
 
 type Stdout struct {
@@ -26,6 +27,9 @@ func NewStdout(parent *core.StageBase) core.Stage {
 }
 
 func (s *Stdout) Attach() error {
+	// colorize --pretty output on terminals
+	s.eio.Color = isatty.IsTerminal(os.Stdout.Fd()) && os.Getenv("NO_COLOR") == ""
+
 	err := s.eio.Attach()
 	if err != nil {
 		return err
@@ -0,0 +1,148 @@
+package stages
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+)
+
+// Tcp exchanges messages over a plain or TLS TCP connection, as a client or a server,
+// eg. newline-delimited JSON for simple line-protocol services.
+// In server mode, each client gets a copy of the output, and all can inject messages.
+type Tcp struct {
+	*core.StageBase
+	sf   sockFlow   // message flow
+	auth authConfig // TLS config and client IP allowlist
+
+	addr    string        // remote or listen address
+	timeout time.Duration // --timeout
+
+	eio *extio.Extio
+}
+
+func NewTcp(parent *core.StageBase) core.Stage {
+	s := &Tcp{StageBase: parent}
+	s.auth.StageBase = parent
+
+	o := &s.Options
+	o.Descr = "filter messages over a TCP connection"
+	o.IsProducer = true
+	o.Bidir = true
+
+	f := o.Flags
+	f.Bool("listen", false, "listen on given address instead of connecting to it")
+	f.Bool("tls", false, "use TLS")
+	addTLSFlags(f)
+	f.Duration("timeout", 10*time.Second, "connect and TLS handshake timeout (0 means none)")
+	addSockFlags(f)
+	o.Args = []string{"addr"}
+
+	o.Events = map[string]string{
+		"connected":    "connection established (value: remote)",
+		"disconnected": "connection closed (value: remote, error)",
+		"denied":       "server client denied (value: remote, reason)",
+	}
+
+	s.eio = extio.NewExtio(parent, 0)
+	s.sf = sockFlow{
+		StageBase: parent,
+		eio:       s.eio,
+		tag:       "tcp/remote",
+		dial:      s.dial,
+		accept:    s.accept,
+	}
+	return s
+}
+
+func (s *Tcp) Attach() error {
+	k := s.K
+
+	// address
+	s.addr = k.String("addr")
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	s.eio.Source = s.addr
+	s.sf.addr = s.addr
+	s.timeout = k.Duration("timeout")
+
+	// TLS config and client IP allowlist
+	if err := s.auth.attach(k.Bool("tls"), k.Bool("listen")); err != nil {
+		return err
+	}
+
+	// formats
+	if k.Bool("pcap") && !k.Bool("write") {
+		return fmt.Errorf("--pcap: requires --write over TCP")
+	}
+
+	if err := s.sf.attach(k.Bool("listen")); err != nil {
+		return err
+	}
+	return s.eio.Attach()
+}
+
+func (s *Tcp) Prepare() error {
+	if !s.K.Bool("listen") {
+		return s.sf.connect()
+	}
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(s.Ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if s.auth.tls != nil {
+		ln = tls.NewListener(ln, s.auth.tls)
+	}
+
+	s.Info().Bool("tls", s.auth.tls != nil).Msgf("listening on %s", ln.Addr())
+	s.sf.serve(ln) // closed in Stop()
+	return nil
+}
+
+func (s *Tcp) Run() error {
+	return s.sf.run()
+}
+
+func (s *Tcp) Stop() error {
+	return s.sf.stop()
+}
+
+// dial connects to the TCP server
+func (s *Tcp) dial() (net.Conn, error) {
+	s.Info().Bool("tls", s.auth.tls != nil).Msgf("connecting to %s", s.addr)
+	dialer := &net.Dialer{Timeout: s.timeout}
+	if s.auth.tls == nil {
+		return dialer.DialContext(s.Ctx, "tcp", s.addr)
+	}
+
+	tdialer := &tls.Dialer{NetDialer: dialer, Config: s.auth.clientTLS()}
+	return tdialer.DialContext(s.Ctx, "tcp", s.addr)
+}
+
+// accept checks a new server conn, completing the TLS handshake if needed
+func (s *Tcp) accept(conn net.Conn) (string, error) {
+	remote := conn.RemoteAddr().String()
+	if err := s.auth.connCheck(remote); err != nil {
+		return remote, err
+	}
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := s.Ctx, context.CancelFunc(func() {})
+		if s.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		}
+		defer cancel()
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return remote, fmt.Errorf("TLS handshake: %w", err)
+		}
+	}
+
+	return remote, nil
+}
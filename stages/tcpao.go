@@ -0,0 +1,80 @@
+package stages
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// aoKey is a TCP-AO (RFC 5925) master key tuple
+type aoKey struct {
+	peer   netip.Prefix // remote address prefix (invalid means any)
+	sndid  uint8        // SendID
+	rcvid  uint8        // RecvID
+	alg    string       // Linux crypto algorithm name
+	secret string       // master key
+}
+
+// aoAlgs maps TCP-AO algorithm names (RFC 5926) to Linux crypto names
+var aoAlgs = map[string]string{
+	"hmac-sha-1-96":   "hmac(sha1)",
+	"hmac-sha1":       "hmac(sha1)",
+	"sha1":            "hmac(sha1)",
+	"aes-128-cmac-96": "cmac(aes128)",
+	"aes-128-cmac":    "cmac(aes128)",
+	"aes128":          "cmac(aes128)",
+}
+
+// addAoFlags adds the --ao-key flag to f
+func addAoFlags(f *pflag.FlagSet) {
+	f.StringArray("ao-key", []string{}, "TCP-AO key as [PEER@]SNDID:RCVID:ALG:SECRET, first one preferred (may be repeated)")
+}
+
+// parseAoKeys parses --ao-key values, eg. "1:1:aes-128-cmac-96:secret"
+// or "192.0.2.0/24@2:3:hmac-sha-1-96:secret"
+func parseAoKeys(vals []string) (keys []aoKey, err error) {
+	for _, v := range vals {
+		var k aoKey
+
+		// peer prefix?
+		if before, after, ok := strings.Cut(v, "@"); ok {
+			if p, err := netip.ParsePrefix(before); err == nil {
+				k.peer, v = p.Masked(), after
+			} else if a, err := netip.ParseAddr(before); err == nil {
+				k.peer, v = netip.PrefixFrom(a, a.BitLen()), after
+			}
+		}
+
+		// key IDs, algorithm, and secret
+		f := strings.SplitN(v, ":", 4)
+		if len(f) != 4 {
+			return nil, fmt.Errorf("%s: need SNDID:RCVID:ALG:SECRET", v)
+		}
+		for i, id := range []*uint8{&k.sndid, &k.rcvid} {
+			n, err := strconv.ParseUint(f[i], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid key ID: %s", v, f[i])
+			}
+			*id = uint8(n)
+		}
+		if k.alg = aoAlgs[strings.ToLower(f[2])]; k.alg == "" {
+			return nil, fmt.Errorf("%s: invalid algorithm: %s (need hmac-sha-1-96 or aes-128-cmac-96)", v, f[2])
+		}
+		if k.secret = f[3]; len(k.secret) == 0 || len(k.secret) > 80 {
+			return nil, fmt.Errorf("%s: secret must have 1-80 characters", v)
+		}
+
+		// the same IDs for the same peer?
+		for _, k2 := range keys {
+			if k2.peer == k.peer && (k2.sndid == k.sndid || k2.rcvid == k.rcvid) {
+				return nil, fmt.Errorf("%s: duplicate key ID", v)
+			}
+		}
+
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
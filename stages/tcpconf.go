@@ -0,0 +1,89 @@
+package stages
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/spf13/pflag"
+)
+
+// tcpConfig implements the TCP socket options of connect and listen
+type tcpConfig struct {
+	*core.StageBase
+
+	md5       string        // --md5
+	ao        []aoKey       // --ao-key
+	ttlsec    int           // --ttl-security (0 means off)
+	device    string        // --device
+	keepalive time.Duration // --keepalive (negative means off)
+	usertime  time.Duration // --user-timeout (0 means system default)
+}
+
+// addTcpFlags adds the tcpConfig flags to f, except for --md5 and --ao-key
+func addTcpFlags(f *pflag.FlagSet) {
+	f.Int("ttl-security", 0, "GTSM (RFC 5082): send with TTL 255, accept peers up to N hops away (0 means off)")
+	f.String("device", "", "bind the socket to given network device or VRF")
+	f.Duration("keepalive", 15*time.Second, "TCP keepalive interval (0 means off)")
+	f.Duration("user-timeout", 0, "TCP_USER_TIMEOUT: drop the connection if sent data is not acked in time (0 means system default)")
+}
+
+// attach configures t from the stage flags
+func (t *tcpConfig) attach() (err error) {
+	k := t.K
+
+	// TCP-MD5 or TCP-AO
+	t.md5 = k.String("md5")
+	t.ao, err = parseAoKeys(k.Strings("ao-key"))
+	if err != nil {
+		return fmt.Errorf("--ao-key: %w", err)
+	} else if len(t.ao) > 0 && len(t.md5) > 0 {
+		return fmt.Errorf("--ao-key: can't use with --md5")
+	}
+
+	// socket options
+	t.ttlsec = k.Int("ttl-security")
+	if t.ttlsec < 0 || t.ttlsec > 254 {
+		return fmt.Errorf("--ttl-security: must be 1-254 hops, or 0 for off")
+	}
+	t.device = k.String("device")
+	t.keepalive = k.Duration("keepalive")
+	if t.keepalive == 0 {
+		t.keepalive = -1 // NB: 0 means the Go default
+	}
+	t.usertime = k.Duration("user-timeout")
+	if t.usertime < 0 {
+		return fmt.Errorf("--user-timeout: must not be negative")
+	}
+
+	return nil
+}
+
+// control returns the socket control function for net.Dialer and net.ListenConfig
+func (t *tcpConfig) control() func(net, addr string, c syscall.RawConn) error {
+	var fns []func(net, addr string, c syscall.RawConn) error
+	if len(t.ao) > 0 {
+		fns = append(fns, tcp_ao(t.ao))
+	} else if len(t.md5) > 0 {
+		fns = append(fns, tcp_md5(t.md5))
+	}
+	if t.ttlsec > 0 || len(t.device) > 0 || t.usertime > 0 {
+		fns = append(fns, tcp_sockopt(t.ttlsec, t.device, t.usertime))
+	}
+
+	switch len(fns) {
+	case 0:
+		return nil
+	case 1:
+		return fns[0]
+	}
+	return func(net, addr string, c syscall.RawConn) error {
+		for _, fn := range fns {
+			if err := fn(net, addr, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
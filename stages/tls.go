@@ -0,0 +1,200 @@
+package stages
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloader caches a value parsed from files, parsing them again when any changes.
+// A reloader without paths returns a static value.
+type reloader[T any] struct {
+	paths []string
+	parse func(data [][]byte) (T, error)
+
+	mu    sync.Mutex
+	val   T           // last good value
+	stamp []fileStamp // files state for val
+	check time.Time   // last check for changes
+}
+
+type fileStamp struct {
+	mtime time.Time
+	size  int64
+}
+
+// newReloader returns a new reloader for given paths, loading the value now
+func newReloader[T any](parse func(data [][]byte) (T, error), paths ...string) (*reloader[T], error) {
+	r := &reloader[T]{paths: paths, parse: parse}
+	_, err := r.Get()
+	return r, err
+}
+
+// Get returns the current value, reloading it if the files changed (checked at most once a second).
+// On error, returns the last good value and the error.
+func (r *reloader[T]) Get() (T, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if len(r.paths) == 0 || now.Sub(r.check) < time.Second {
+		return r.val, nil
+	}
+	r.check = now
+
+	// any changes?
+	stamp := make([]fileStamp, len(r.paths))
+	for i, path := range r.paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return r.val, err
+		}
+		stamp[i] = fileStamp{fi.ModTime(), fi.Size()}
+	}
+	if slices.Equal(stamp, r.stamp) {
+		return r.val, nil
+	}
+
+	// reload
+	data := make([][]byte, len(r.paths))
+	for i, path := range r.paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return r.val, err
+		}
+		data[i] = buf
+	}
+	val, err := r.parse(data)
+	if err != nil {
+		return r.val, err
+	}
+
+	r.val, r.stamp = val, stamp
+	return val, nil
+}
+
+// newCertReloader returns a reloader for a TLS certificate and its private key
+func newCertReloader(cert, key string) (*reloader[*tls.Certificate], error) {
+	return newReloader(func(data [][]byte) (*tls.Certificate, error) {
+		cert, err := tls.X509KeyPair(data[0], data[1])
+		return &cert, err
+	}, cert, key)
+}
+
+// newCAReloader returns a reloader for a PEM bundle of CA certificates
+func newCAReloader(path string) (*reloader[*x509.CertPool], error) {
+	return newReloader(func(data [][]byte) (*x509.CertPool, error) {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data[0]) {
+			return nil, fmt.Errorf("no certificates found")
+		}
+		return pool, nil
+	}, path)
+}
+
+// newSecretReloader returns a reloader for the non-empty lines of secret v,
+// which is either $ENV_VARIABLE (static) or a file path (reloaded on change).
+// Lines starting with # are ignored.
+func newSecretReloader(v string) (*reloader[[]string], error) {
+	parse := func(data [][]byte) (lines []string, err error) {
+		for _, line := range bytes.Split(data[0], []byte{'\n'}) {
+			if line = bytes.TrimSpace(line); len(line) > 0 && line[0] != '#' {
+				lines = append(lines, string(line))
+			}
+		}
+		if len(lines) == 0 {
+			return nil, fmt.Errorf("no secrets found")
+		}
+		return lines, nil
+	}
+
+	if len(v) >= 2 && v[0] == '$' {
+		val, err := parse([][]byte{[]byte(os.Getenv(v[1:]))})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", v, err)
+		}
+		return &reloader[[]string]{val: val}, nil
+	}
+	return newReloader(parse, v)
+}
+
+// matchSecret returns true iff val is one of secrets, in constant time for each
+func matchSecret(secrets []string, val string) (ok bool) {
+	for _, s := range secrets {
+		if subtle.ConstantTimeCompare([]byte(s), []byte(val)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// matchCertName returns true iff cert subject CN or any of its SANs is in names
+func matchCertName(cert *x509.Certificate, names []string) bool {
+	cand := []string{cert.Subject.CommonName}
+	cand = append(cand, cert.DNSNames...)
+	cand = append(cand, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		cand = append(cand, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		cand = append(cand, uri.String())
+	}
+
+	for _, c := range cand {
+		if len(c) > 0 && slices.Contains(names, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePins parses SHA-256 certificate fingerprints in hex, eg. as printed
+// by openssl x509 -fingerprint -sha256 (colons are optional)
+func parsePins(vals []string) (ret [][]byte, err error) {
+	for _, v := range vals {
+		for _, v := range strings.Split(v, ",") {
+			if v = strings.TrimSpace(v); len(v) == 0 {
+				continue
+			}
+			if _, after, found := strings.Cut(v, "="); found {
+				v = after // skip "SHA256 Fingerprint="
+			}
+			pin, err := hex.DecodeString(strings.ReplaceAll(v, ":", ""))
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("invalid SHA-256 fingerprint: %s", v)
+			}
+			ret = append(ret, pin)
+		}
+	}
+	return ret, nil
+}
+
+// verifyCert returns a tls.Config.VerifyConnection func requiring the remote
+// certificate to match any of names (if not empty) and any of pins (if not empty)
+func verifyCert(names []string, pins [][]byte) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("no remote certificate")
+		}
+		cert := cs.PeerCertificates[0]
+		if len(names) > 0 && !matchCertName(cert, names) {
+			return fmt.Errorf("remote certificate name not allowed: %s", cert.Subject)
+		}
+		if len(pins) > 0 {
+			sum := sha256.Sum256(cert.Raw)
+			if !slices.ContainsFunc(pins, func(pin []byte) bool { return bytes.Equal(pin, sum[:]) }) {
+				return fmt.Errorf("remote certificate not pinned: %s (%x)", cert.Subject, sum)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,162 @@
+package stages
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+)
+
+// Unix exchanges messages over a Unix domain socket, as a client or a server.
+// In server mode, any number of local clients can attach and detach freely:
+// each gets a copy of the output, and all can inject messages.
+type Unix struct {
+	*core.StageBase
+	sf sockFlow // message flow
+
+	path    string        // socket path
+	network string        // unix or unixpacket
+	perm    os.FileMode   // --perm
+	timeout time.Duration // --timeout
+	seq     atomic.Int64  // last server conn number
+
+	eio *extio.Extio
+}
+
+func NewUnix(parent *core.StageBase) core.Stage {
+	s := &Unix{StageBase: parent}
+
+	o := &s.Options
+	o.Descr = "filter messages over a Unix domain socket"
+	o.IsProducer = true
+	o.Bidir = true
+
+	f := o.Flags
+	f.Bool("listen", false, "listen on given path instead of connecting to it")
+	f.Bool("seqpacket", false, "use a SOCK_SEQPACKET socket, one message per packet")
+	f.String("perm", "0660", "in server mode, socket file permissions (octal)")
+	f.Duration("timeout", 10*time.Second, "connect timeout (0 means none)")
+	addSockFlags(f)
+	o.Args = []string{"path"}
+
+	o.Events = map[string]string{
+		"connected":    "connection established (value: remote)",
+		"disconnected": "connection closed (value: remote, error)",
+	}
+
+	s.eio = extio.NewExtio(parent, 0)
+	s.sf = sockFlow{
+		StageBase: parent,
+		eio:       s.eio,
+		tag:       "unix/remote",
+		dial:      s.dial,
+		accept:    s.accept,
+	}
+	return s
+}
+
+func (s *Unix) Attach() error {
+	k := s.K
+
+	// socket path
+	s.path = k.String("path")
+	if len(s.path) == 0 {
+		return errors.New("path must be set")
+	} else if s.path[0] != '@' { // not a Linux abstract socket
+		s.path = filepath.Clean(s.path)
+	}
+	s.eio.Source = s.path
+	s.sf.addr = s.path
+
+	// options
+	s.sf.packet = k.Bool("seqpacket")
+	if s.sf.packet {
+		s.network = "unixpacket"
+	} else {
+		s.network = "unix"
+	}
+	perm, err := strconv.ParseUint(k.String("perm"), 8, 32)
+	if err != nil || perm > 0o777 {
+		return fmt.Errorf("--perm: invalid octal file mode: %s", k.String("perm"))
+	}
+	s.perm = os.FileMode(perm)
+	s.timeout = k.Duration("timeout")
+
+	// formats
+	if k.Bool("pcap") && (s.sf.packet || !k.Bool("write")) {
+		return fmt.Errorf("--pcap: requires --write over unix stream sockets")
+	}
+
+	if err := s.sf.attach(k.Bool("listen")); err != nil {
+		return err
+	}
+	return s.eio.Attach()
+}
+
+func (s *Unix) Prepare() error {
+	if !s.K.Bool("listen") {
+		return s.sf.connect()
+	}
+
+	// remove a stale socket file, left by a previous run
+	abstract := s.path[0] == '@'
+	if fi, err := os.Lstat(s.path); !abstract && err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.DialTimeout(s.network, s.path, time.Second)
+		switch {
+		case err == nil:
+			conn.Close()
+			return fmt.Errorf("%s: socket already in use", s.path)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			s.Debug().Msgf("removing stale socket %s", s.path)
+			os.Remove(s.path)
+		}
+	}
+
+	// listen
+	ln, err := net.Listen(s.network, s.path)
+	if err != nil {
+		return err
+	}
+	if !abstract {
+		if err := os.Chmod(s.path, s.perm); err != nil {
+			ln.Close()
+			return fmt.Errorf("--perm: %w", err)
+		}
+	}
+
+	s.Info().Msgf("listening on %s", s.path)
+	s.sf.serve(ln) // closed (and removed) in Stop()
+	return nil
+}
+
+func (s *Unix) Run() error {
+	return s.sf.run()
+}
+
+func (s *Unix) Stop() error {
+	return s.sf.stop()
+}
+
+// dial connects to the unix socket server
+func (s *Unix) dial() (net.Conn, error) {
+	s.Info().Msgf("connecting to %s", s.path)
+	dialer := net.Dialer{Timeout: s.timeout}
+	return dialer.DialContext(s.Ctx, s.network, s.path)
+}
+
+// accept describes a new server conn, using the peer credentials if possible
+func (s *Unix) accept(conn net.Conn) (string, error) {
+	remote := fmt.Sprintf("#%d", s.seq.Add(1))
+	if peer := unix_peer(conn); peer != "" {
+		remote += "/" + peer
+	}
+	return remote, nil
+}
@@ -2,6 +2,7 @@ package stages
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -14,8 +15,15 @@ func tcp_handle(s *core.StageBase, conn net.Conn, in *pipe.Input) error {
 	s.Info().Msgf("connected %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
 	defer conn.Close()
 
-	// get tcp conn
+	// publish peer metadata
+	s.PeerUp(conn)
+	defer s.PeerDown()
+
+	// get tcp conn, possibly under TLS
 	tcp, _ := conn.(*net.TCPConn)
+	if tc, ok := conn.(*tls.Conn); ok {
+		tcp, _ = tc.NetConn().(*net.TCPConn)
+	}
 	if tcp == nil {
 		return fmt.Errorf("could not get TCPConn")
 	}
@@ -37,16 +45,18 @@ func tcp_handle(s *core.StageBase, conn net.Conn, in *pipe.Input) error {
 	go func() {
 		n, err := io.Copy(in, conn)
 		s.Trace().Err(err).Msg("connection reader returned")
-		tcp.CloseRead()
+		if conn == net.Conn(tcp) {
+			tcp.CloseRead()
+		}
 		rch <- retval{n, err}
 	}()
 
 	// write to conn
 	go func() {
 		pipeline := s.P.LineFor(s.Dir.Flip())
-		n, err := tcp.ReadFrom(pipeline)
+		n, err := io.Copy(conn, pipeline)
 		s.Trace().Err(err).Msg("connection writer returned")
-		tcp.CloseWrite()
+		conn.(interface{ CloseWrite() error }).CloseWrite()
 		wch <- retval{n, err}
 	}()
 
@@ -3,7 +3,13 @@
 package stages
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -42,3 +48,154 @@ func tcp_md5(md5pass string) func(net, addr string, c syscall.RawConn) error {
 		return err
 	}
 }
+
+// TCP-AO socket options (linux/tcp.h, Linux 6.7+)
+const (
+	tcp_AO_ADD_KEY = 38
+	tcp_AO_INFO    = 40
+)
+
+func tcp_ao(keys []aoKey) func(net, addr string, c syscall.RawConn) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return func(net, addr string, c syscall.RawConn) error {
+		// IPv6 sockets may get IPv4 peers too
+		var unspec []netip.Prefix
+		is6 := false
+		switch net {
+		case "tcp6", "udp6", "ip6":
+			is6 = true
+			unspec = []netip.Prefix{netip.PrefixFrom(netip.IPv6Unspecified(), 0)}
+		}
+		unspec = append(unspec, netip.PrefixFrom(netip.IPv4Unspecified(), 0))
+
+		// add in reverse order, as Linux prefers the last key added
+		var err error
+		add := func(fd int, k aoKey) {
+			if err == nil {
+				err = unix.SetsockoptString(fd, unix.IPPROTO_TCP, tcp_AO_ADD_KEY, tcp_ao_add(k))
+			}
+		}
+		c.Control(func(fd uintptr) {
+			for i := len(keys) - 1; i >= 0; i-- {
+				k := keys[i]
+				if k.peer.IsValid() {
+					if is6 || k.peer.Addr().Is4() { // skip IPv6 peers on IPv4 sockets
+						add(int(fd), k)
+					}
+					continue
+				}
+				for _, k.peer = range unspec {
+					add(int(fd), k)
+				}
+			}
+
+			// reject peers without TCP-AO
+			if err == nil {
+				var info [48]byte                                      // struct tcp_ao_info_opt
+				binary.NativeEndian.PutUint32(info[0:], tcp_ao_bit(2)) // ao_required
+				err = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, tcp_AO_INFO, string(info[:]))
+			}
+		})
+		if errors.Is(err, unix.ENOPROTOOPT) {
+			return fmt.Errorf("TCP-AO not supported by the kernel")
+		}
+		return err
+	}
+}
+
+// tcp_ao_add returns struct tcp_ao_add for k
+func tcp_ao_add(k aoKey) string {
+	var b [288]byte
+
+	// struct sockaddr_storage addr
+	a := k.peer.Addr()
+	if a.Is4() {
+		binary.NativeEndian.PutUint16(b[0:], unix.AF_INET)
+		copy(b[4:], a.AsSlice())
+	} else {
+		binary.NativeEndian.PutUint16(b[0:], unix.AF_INET6)
+		copy(b[8:], a.AsSlice())
+	}
+
+	copy(b[128:192], k.alg) // alg_name
+	// ifindex, set_current, set_rnext: zero
+	b[202] = uint8(k.peer.Bits()) // prefix
+	b[203] = k.sndid
+	b[204] = k.rcvid
+	b[205] = 12                             // maclen: 96 bits
+	b[207] = uint8(copy(b[208:], k.secret)) // keylen, key
+	return string(b[:])
+}
+
+// tcp_ao_bit returns bit n of a C bitfield
+func tcp_ao_bit(n int) uint32 {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) == 1 {
+		return 1 << n // little endian
+	}
+	return 1 << (31 - n)
+}
+
+func tcp_sockopt(ttlsec int, device string, usertime time.Duration) func(net, addr string, c syscall.RawConn) error {
+	return func(net, addr string, c syscall.RawConn) error {
+		var err error
+		set := func(fd, level, opt, val int, name string) {
+			if err == nil {
+				if err = unix.SetsockoptInt(fd, level, opt, val); err != nil {
+					err = fmt.Errorf("%s: %w", name, err)
+				}
+			}
+		}
+
+		c.Control(func(fd uintptr) {
+			s := int(fd)
+
+			// GTSM (NB: IPv6 sockets may carry IPv4 too)
+			if ttlsec > 0 {
+				set(s, unix.IPPROTO_IP, unix.IP_TTL, 255, "IP_TTL")
+				set(s, unix.IPPROTO_IP, unix.IP_MINTTL, 256-ttlsec, "IP_MINTTL")
+				switch net {
+				case "tcp6", "udp6", "ip6":
+					set(s, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, 255, "IPV6_UNICAST_HOPS")
+					set(s, unix.IPPROTO_IPV6, unix.IPV6_MINHOPCOUNT, 256-ttlsec, "IPV6_MINHOPCOUNT")
+				}
+			}
+
+			// device or VRF
+			if len(device) > 0 && err == nil {
+				if err = unix.BindToDevice(s, device); err != nil {
+					err = fmt.Errorf("SO_BINDTODEVICE %s: %w", device, err)
+				}
+			}
+
+			// unacked data timeout
+			if usertime > 0 {
+				set(s, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(usertime.Milliseconds()), "TCP_USER_TIMEOUT")
+			}
+		})
+		return err
+	}
+}
+
+// unix_peer returns the credentials of the process on the other side of unix socket conn
+func unix_peer(conn net.Conn) string {
+	uc, _ := conn.(*net.UnixConn)
+	if uc == nil {
+		return ""
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return ""
+	}
+
+	var cred *unix.Ucred
+	rc.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ""
+	}
+	return fmt.Sprintf("pid=%d,uid=%d", cred.Pid, cred.Uid)
+}
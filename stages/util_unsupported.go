@@ -4,7 +4,9 @@ package stages
 
 import (
 	"fmt"
+	"net"
 	"syscall"
+	"time"
 )
 
 func tcp_md5(md5pass string) func(net, addr string, c syscall.RawConn) error {
@@ -16,3 +18,23 @@ func tcp_md5(md5pass string) func(net, addr string, c syscall.RawConn) error {
 		return fmt.Errorf("no TCP-MD5 support on this platform")
 	}
 }
+
+func tcp_ao(keys []aoKey) func(net, addr string, c syscall.RawConn) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return func(net, addr string, c syscall.RawConn) error {
+		return fmt.Errorf("no TCP-AO support on this platform")
+	}
+}
+
+func tcp_sockopt(ttlsec int, device string, usertime time.Duration) func(net, addr string, c syscall.RawConn) error {
+	return func(net, addr string, c syscall.RawConn) error {
+		return fmt.Errorf("no --ttl-security, --device, or --user-timeout support on this platform")
+	}
+}
+
+func unix_peer(conn net.Conn) string {
+	return ""
+}
@@ -0,0 +1,465 @@
+package stages
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+)
+
+// Webhook POSTs messages and pipe events to an HTTP endpoint, in NDJSON batches.
+// Messages use the usual JSON format, events are JSON objects, eg.
+// {"event":"limit/long","time":"...","stage":"[2] limit","value":["10.0.0.0/25",65001]}
+type Webhook struct {
+	*core.StageBase
+
+	url     string      // target URL
+	headers http.Header // HTTP headers
+	auth    authConfig  // TLS and HTTP auth
+
+	opt_timeout  time.Duration
+	opt_batch    int
+	opt_delay    time.Duration
+	opt_retries  int
+	opt_retry    time.Duration
+	opt_retrymax time.Duration
+
+	client *http.Client   // HTTP client
+	pool   *x509.CertPool // --ca pool used by client
+	spool  *webhookSpool  // on-disk spool (may be nil)
+	drain  time.Time      // next spool drain attempt
+	wait   time.Duration  // current spool drain backoff
+	eio    *extio.Extio
+}
+
+var errWebhookPermanent = errors.New("permanent error")
+
+func NewWebhook(parent *core.StageBase) core.Stage {
+	s := &Webhook{StageBase: parent}
+	s.auth.StageBase = parent
+
+	o := &s.Options
+	o.Descr = "send messages and events to an HTTP endpoint"
+	o.Bidir = true
+	o.Args = []string{"url"}
+
+	f := o.Flags
+	f.StringSlice("events", []string{}, "send given pipe events (see bgpipe --events)")
+	f.Bool("no-msgs", false, "do not send messages, only --events")
+	f.StringSlice("header", []string{}, "HTTP headers to send")
+	f.Duration("timeout", 10*time.Second, "HTTP request timeout")
+	f.Int("batch", 100, "maximum number of messages and events per request")
+	f.Duration("batch-delay", time.Second, "maximum delay to fill a --batch")
+	f.Int("retries", 3, "how many times to retry a failed request")
+	f.Duration("retry-delay", time.Second, "delay before the first retry, doubled on each next")
+	f.Duration("retry-max", time.Minute, "maximum delay between retries")
+	f.String("spool", "", "keep undelivered requests in given directory, re-sending them later")
+	f.Int64("spool-max", 100*1024*1024, "maximum --spool size (bytes), dropping the oldest requests")
+	addAuthFlags(f)
+
+	o.Events = map[string]string{
+		"failed":  "request failed after retries (value: count, error)",
+		"spooled": "request spooled (value: count, spool requests)",
+		"dropped": "request dropped (value: count)",
+	}
+
+	s.eio = extio.NewExtio(parent, extio.MODE_WRITE|extio.MODE_COPY)
+
+	// never block the pipe or its events on a dead endpoint by default
+	if fl := f.Lookup("overflow"); fl != nil {
+		fl.DefValue = "drop-oldest"
+		fl.Value.Set(fl.DefValue)
+	}
+
+	return s
+}
+
+func (s *Webhook) Attach() error {
+	k := s.K
+
+	// check URL
+	u, err := url.Parse(k.String("url"))
+	if err != nil {
+		return fmt.Errorf("target URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		break // ok
+	case "":
+		return fmt.Errorf("target URL: needs 'http://' or 'https://' scheme prefix")
+	default:
+		return fmt.Errorf("target URL: invalid scheme: %s", u.Scheme)
+	}
+	s.url = u.String()
+
+	// options
+	s.opt_timeout = k.Duration("timeout")
+	s.opt_batch = k.Int("batch")
+	s.opt_delay = k.Duration("batch-delay")
+	s.opt_retries = k.Int("retries")
+	s.opt_retry = k.Duration("retry-delay")
+	s.opt_retrymax = k.Duration("retry-max")
+	switch {
+	case s.opt_timeout <= 0:
+		return fmt.Errorf("--timeout: must be positive")
+	case s.opt_batch < 1:
+		return fmt.Errorf("--batch: must be at least 1")
+	case s.opt_delay < 0:
+		return fmt.Errorf("--batch-delay: must not be negative")
+	case s.opt_retries < 0:
+		return fmt.Errorf("--retries: must not be negative")
+	case s.opt_retry <= 0 || s.opt_retrymax < s.opt_retry:
+		return fmt.Errorf("--retry-delay and --retry-max: must be positive, max not less than delay")
+	}
+
+	// JSON only
+	for _, v := range []string{"raw", "mrt", "pcap", "proto", "parquet", "csv", "bgpdump", "pretty"} {
+		if k.Bool(v) {
+			return fmt.Errorf("--%s: not supported, webhook sends JSON", v)
+		}
+	}
+
+	// SSL config and auth
+	if err := s.auth.attach(u.Scheme == "https", false); err != nil {
+		return err
+	}
+
+	// HTTP headers
+	s.headers = make(http.Header)
+	s.headers.Set("User-Agent", "bgpipe")
+	for _, v := range k.Strings("header") {
+		key, val, found := strings.Cut(v, ":")
+		if !found {
+			return fmt.Errorf("--header %s: colon not found", v)
+		}
+		s.headers.Set(key, val)
+	}
+	s.headers.Set("Content-Type", "application/x-ndjson")
+
+	// spool
+	if dir := k.String("spool"); dir != "" {
+		s.spool, err = openWebhookSpool(dir, k.Int64("spool-max"))
+		if err != nil {
+			return fmt.Errorf("--spool: %w", err)
+		}
+	}
+
+	// send messages?
+	if err := s.eio.Attach(); err != nil {
+		return err
+	}
+	if k.Bool("no-msgs") {
+		s.eio.Callback.Dropped = true
+	}
+
+	// send events?
+	if evs := s.B.ParseEvents(k, "events"); len(evs) > 0 {
+		s.P.Options.AddHandler(s.onEvent, &pipe.Handler{Types: evs})
+	} else if k.Bool("no-msgs") {
+		return fmt.Errorf("--no-msgs: requires --events")
+	}
+
+	return nil
+}
+
+func (s *Webhook) Prepare() error {
+	if s.spool != nil && s.spool.len() > 0 {
+		s.Info().Msgf("spool has %d requests to re-send", s.spool.len())
+	}
+	return nil
+}
+
+func (s *Webhook) Stop() error {
+	s.eio.OutputClose()
+	return nil
+}
+
+func (s *Webhook) Run() error {
+	for {
+		body, count, ok := s.collect()
+		if count > 0 {
+			s.deliver(body, count)
+		}
+		if !ok {
+			return nil
+		}
+	}
+}
+
+// webhookEvent is a pipe event sent to the endpoint
+type webhookEvent struct {
+	Event string            `json:"event"`
+	Time  time.Time         `json:"time"`
+	Seq   uint64            `json:"seq,omitempty"`
+	Dir   string            `json:"dir,omitempty"`
+	Stage string            `json:"stage,omitempty"`
+	Error string            `json:"error,omitempty"`
+	Value []json.RawMessage `json:"value,omitempty"`
+	Msg   json.RawMessage   `json:"msg,omitempty"`
+}
+
+// onEvent queues ev for sending
+func (s *Webhook) onEvent(ev *pipe.Event) bool {
+	we := webhookEvent{
+		Event: ev.Type,
+		Time:  ev.Time,
+		Seq:   ev.Seq,
+	}
+	if ev.Dir != 0 {
+		we.Dir = ev.Dir.String()
+	}
+	if ev.Error != nil {
+		we.Error = ev.Error.Error()
+	}
+	if ev.Msg != nil {
+		we.Msg = bytes.TrimSpace(ev.Msg.GetJSON())
+	}
+
+	// values, possibly with the stage as the last one
+	vals, _ := ev.Value.([]any)
+	if ev.Value != nil && vals == nil {
+		vals = []any{ev.Value}
+	}
+	if n := len(vals); n > 0 {
+		if sb, _ := vals[n-1].(*core.StageBase); sb != nil {
+			we.Stage = sb.String()
+			vals = vals[:n-1]
+		}
+	}
+	for _, v := range vals {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		buf, err := json.Marshal(v)
+		if err != nil {
+			buf, _ = json.Marshal(fmt.Sprint(v))
+		}
+		we.Value = append(we.Value, buf)
+	}
+
+	// queue
+	bb := s.eio.Pool.Get()
+	buf, err := json.Marshal(&we)
+	if err != nil {
+		s.Warn().Err(err).Msgf("could not marshal event %s", ev)
+		s.eio.Put(bb)
+		return true
+	}
+	bb.B = append(bb.B, buf...)
+	bb.B = append(bb.B, '\n')
+	s.eio.Queue(s.eio.Output, bb)
+	return true
+}
+
+// collect returns the next batch from the output, and false if the output is done
+func (s *Webhook) collect() (body []byte, count int, ok bool) {
+	add := func(bb []byte) {
+		body = append(body, bb...)
+		count++
+	}
+
+	// wait for the first one, or the next spool drain attempt
+	for count == 0 {
+		var (
+			timer *time.Timer
+			drain <-chan time.Time
+		)
+		if s.spool != nil && s.spool.len() > 0 {
+			timer = time.NewTimer(time.Until(s.drain))
+			drain = timer.C
+		}
+
+		select {
+		case bb, ok := <-s.eio.Output:
+			if !ok {
+				return nil, 0, false
+			} else if bb != nil {
+				add(bb.B)
+				s.eio.Put(bb)
+			}
+		case <-drain:
+			s.drainSpool()
+		case <-s.Ctx.Done():
+			return nil, 0, false
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	// fill the batch
+	timer := time.NewTimer(s.opt_delay)
+	defer timer.Stop()
+	for count < s.opt_batch {
+		select {
+		case bb, ok := <-s.eio.Output:
+			if !ok {
+				return body, count, false
+			} else if bb != nil {
+				add(bb.B)
+				s.eio.Put(bb)
+			}
+		case <-timer.C:
+			return body, count, true
+		case <-s.Ctx.Done():
+			return body, count, false
+		}
+	}
+	return body, count, true
+}
+
+// deliver sends a batch of count lines in body, spooling it if needed
+func (s *Webhook) deliver(body []byte, count int) {
+	// anything spooled before? keep the order
+	if s.spool != nil && s.spool.len() > 0 {
+		s.toSpool(body, count)
+		s.drainSpool()
+		return
+	}
+
+	// try sending, with retries
+	err := s.send(body)
+	if err == nil {
+		return
+	}
+	s.Warn().Err(err).Int("count", count).Msg("could not deliver request")
+	s.Event("failed", count, err)
+
+	if s.spool != nil && !errors.Is(err, errWebhookPermanent) {
+		s.toSpool(body, count)
+	} else {
+		s.Event("dropped", count)
+	}
+}
+
+// send posts body, retrying with backoff if needed
+func (s *Webhook) send(body []byte) error {
+	delay := s.opt_retry
+	for try := 0; ; try++ {
+		err := s.post(body)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, errWebhookPermanent) || try >= s.opt_retries || s.Ctx.Err() != nil:
+			return err
+		}
+
+		s.Debug().Err(err).Msgf("request failed, retrying in %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-s.Ctx.Done():
+			return err
+		}
+		delay = min(delay*2, s.opt_retrymax)
+	}
+}
+
+// post makes a single POST request with body
+func (s *Webhook) post(body []byte) error {
+	req, err := http.NewRequestWithContext(s.Ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = s.headers.Clone()
+	s.auth.clientAuth(req.Header)
+
+	resp, err := s.getClient().Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return nil
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	default:
+		return fmt.Errorf("%w: HTTP status %s", errWebhookPermanent, resp.Status)
+	}
+}
+
+// getClient returns the HTTP client, re-creating it if the --ca bundle changed
+func (s *Webhook) getClient() *http.Client {
+	var pool *x509.CertPool
+	if s.auth.cas != nil {
+		pool, _ = s.auth.cas.Get()
+	}
+	if s.client != nil && pool == s.pool {
+		return s.client
+	}
+
+	if s.client != nil {
+		s.client.CloseIdleConnections()
+	}
+	s.pool = pool
+	s.client = &http.Client{
+		Timeout: s.opt_timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: s.auth.clientTLS(),
+		},
+	}
+	return s.client
+}
+
+// toSpool stores a batch of count lines in body in the spool
+func (s *Webhook) toSpool(body []byte, count int) {
+	dropped, err := s.spool.add(body)
+	if err != nil {
+		s.Error().Err(err).Int("count", count).Msg("could not spool request")
+		s.Event("dropped", count)
+		return
+	}
+	s.Event("spooled", count, s.spool.len())
+	if dropped > 0 {
+		s.Warn().Msgf("spool full, dropped %d oldest requests", dropped)
+		s.Event("dropped", dropped)
+	}
+}
+
+// drainSpool tries re-sending the spooled requests, oldest first
+func (s *Webhook) drainSpool() {
+	if time.Now().Before(s.drain) {
+		return
+	}
+
+	for s.spool.len() > 0 && s.Ctx.Err() == nil {
+		body, err := s.spool.peek()
+		if err != nil {
+			s.Error().Err(err).Msg("dropping unreadable spooled request")
+		} else {
+			err = s.post(body)
+		}
+
+		switch {
+		case err == nil:
+			s.wait = 0
+		case body == nil || errors.Is(err, errWebhookPermanent):
+			s.Warn().Err(err).Msg("dropped spooled request")
+			s.Event("dropped", bytes.Count(body, []byte{'\n'}))
+		default:
+			s.wait = min(max(s.wait*2, s.opt_retry), s.opt_retrymax)
+			s.drain = time.Now().Add(s.wait)
+			s.Debug().Err(err).Msgf("spool drain failed, retrying in %s", s.wait)
+			return
+		}
+
+		if err := s.spool.pop(); err != nil {
+			s.Error().Err(err).Msg("could not remove spooled request")
+			return
+		}
+	}
+}
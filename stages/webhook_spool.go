@@ -0,0 +1,122 @@
+package stages
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// webhookSpool keeps undelivered webhook requests in a directory, one file per request.
+// The total size is bounded by max, dropping the oldest requests if needed.
+type webhookSpool struct {
+	dir   string
+	max   int64
+	files []spoolFile // oldest first
+	size  int64       // total size of files
+}
+
+type spoolFile struct {
+	name string
+	size int64
+}
+
+const spoolExt = ".ndjson"
+
+// openWebhookSpool opens the spool in dir, creating it if needed
+func openWebhookSpool(dir string, max int64) (*webhookSpool, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("--spool-max: must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	// load existing requests
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sp := &webhookSpool{dir: dir, max: max}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), spoolExt) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		sp.files = append(sp.files, spoolFile{e.Name(), fi.Size()})
+		sp.size += fi.Size()
+	}
+	slices.SortFunc(sp.files, func(a, b spoolFile) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	return sp, nil
+}
+
+// len returns the number of spooled requests
+func (sp *webhookSpool) len() int {
+	return len(sp.files)
+}
+
+// add stores body as the newest request, returning the number of oldest requests dropped
+func (sp *webhookSpool) add(body []byte) (dropped int, err error) {
+	if int64(len(body)) > sp.max {
+		return 0, fmt.Errorf("request larger than --spool-max")
+	}
+
+	// a unique name, sorted after all others
+	name := fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolExt)
+	if n := len(sp.files); n > 0 && name <= sp.files[n-1].name {
+		var last int64
+		fmt.Sscanf(sp.files[n-1].name, "%d", &last)
+		name = fmt.Sprintf("%020d%s", last+1, spoolExt)
+	}
+
+	// write atomically
+	path := filepath.Join(sp.dir, name)
+	if err := os.WriteFile(path+".tmp", body, 0o600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+	sp.files = append(sp.files, spoolFile{name, int64(len(body))})
+	sp.size += int64(len(body))
+
+	// over the limit?
+	for sp.size > sp.max && len(sp.files) > 0 {
+		if err := sp.pop(); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+// peek returns the oldest request
+func (sp *webhookSpool) peek() ([]byte, error) {
+	if len(sp.files) == 0 {
+		return nil, nil
+	}
+	return os.ReadFile(filepath.Join(sp.dir, sp.files[0].name))
+}
+
+// pop removes the oldest request
+func (sp *webhookSpool) pop() error {
+	if len(sp.files) == 0 {
+		return nil
+	}
+	f := sp.files[0]
+	if err := os.Remove(filepath.Join(sp.dir, f.name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sp.files = sp.files[1:]
+	sp.size -= f.size
+	return nil
+}
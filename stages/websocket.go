@@ -3,15 +3,18 @@ package stages
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
-	"encoding/base64"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bgpfix/bgpfix/msg"
@@ -19,25 +22,70 @@ import (
 	"github.com/bgpfix/bgpipe/core"
 	"github.com/bgpfix/bgpipe/pkg/extio"
 	"github.com/gorilla/websocket"
+	"github.com/valyala/bytebufferpool"
 )
 
 type Websocket struct {
 	*core.StageBase
 
-	timeout time.Duration // --timeout
-	tls     *tls.Config   // TLS config (may be nil)
-	headers http.Header   // HTTP headers
-
-	url        url.URL              // URL address
-	srv        *http.Server         // http server (may be nil)
-	clientConn *websocket.Conn      // websocket client conn
-	serverConn chan *websocket.Conn // websocket server conns
+	timeout   time.Duration // --timeout
+	retry     bool          // --retry
+	retryMax  time.Duration // --retry-max
+	keepalive time.Duration // --keepalive
+	idle      time.Duration // --idle-timeout
+	resume    bool          // --resume
+	compress  int           // --compress-level, or 0 if --compress not set
+	batch     int           // --batch
+	batchWait time.Duration // --batch-delay
+	binary    bool          // binary output format?
+	headers   http.Header   // HTTP headers
+	auth      authConfig    // TLS and HTTP auth
+
+	url        url.URL                    // URL address
+	srv        *http.Server               // http server (may be nil)
+	clientMu   sync.Mutex                 // guards clientConn
+	clientConn *websocket.Conn            // websocket client conn
+	fan        fanout                     // output to websocket server conns
+	pending    *bytebufferpool.ByteBuffer // client output to re-send after reconnect
+	stopping   atomic.Bool                // Stop() called?
+
+	// --resume: the client numbers its frames in a random stream ID,
+	// and the server tells on connect how many frames it got so far
+	resumeID  string                   // client stream ID
+	resumeAck int64                    // client: frames the server got, or -1 if unknown
+	sentN     int64                    // client: frames sent
+	sent      []wsFrame                // client: recently sent frames
+	resumeMu  sync.Mutex               // guards resumeRcv
+	resumeRcv map[string]*atomic.Int64 // server: frames received per stream ID
 
 	eio *extio.Extio
 }
 
+// wsFrame is a frame sent by the websocket client, for --resume
+type wsFrame struct {
+	n   int64  // frame number in the stream
+	buf []byte // frame data
+}
+
+// resume headers
+const (
+	wsStreamHeader = "X-Bgpipe-Stream" // client stream ID
+	wsResumeHeader = "X-Bgpipe-Resume" // number of client frames received by the server
+)
+
+// wsClient is a websocket server connection
+type wsClient struct {
+	*fanClient
+	conn   *websocket.Conn
+	remote string                       // remote address
+	write  bool                         // read-write role?
+	rcvd   *atomic.Int64                // frames received in the --resume stream (may be nil)
+	sub    atomic.Pointer[extio.Filter] // subscription (nil means all messages)
+}
+
 func NewWebsocket(parent *core.StageBase) core.Stage {
 	s := &Websocket{StageBase: parent}
+	s.auth.StageBase = parent
 
 	o := &s.Options
 	o.Descr = "filter messages over websocket"
@@ -46,14 +94,27 @@ func NewWebsocket(parent *core.StageBase) core.Stage {
 
 	f := o.Flags
 	f.Bool("listen", false, "listen on given URL instead of dialing it")
-	f.String("auth", "", "use HTTP basic auth ($ENV_VARIABLE or file path with user:pass)")
-	f.String("cert", "", "SSL certificate path")
-	f.String("key", "", "SSL private key path")
-	f.Bool("insecure", false, "do not verify the SSL certificate")
+	addAuthFlags(f)
 	f.StringSlice("header", []string{}, "HTTP headers to send in client mode")
 	f.Duration("timeout", time.Second*10, "connect timeout (0 means none)")
+	f.Bool("retry", false, "in client mode, reconnect when the connection fails")
+	f.Duration("retry-max", time.Minute, "maximum delay between reconnects")
+	f.Duration("keepalive", 30*time.Second, "send pings at this interval (0 means never)")
+	f.Duration("idle-timeout", 90*time.Second, "close connections idle for this long (0 means never)")
+	f.Bool("resume", false, "client: after reconnect, re-send the frames the server missed (server: must be set too)")
+	f.Bool("compress", false, "negotiate permessage-deflate compression")
+	f.Int("compress-level", 1, "compression level (1-9)")
+	f.Int("batch", 0, "pack messages into frames of about this many bytes (0 means no batching)")
+	f.Duration("batch-delay", 10*time.Millisecond, "maximum delay to fill a --batch frame")
 	o.Args = []string{"url"}
 
+	o.Events = map[string]string{
+		"connected":    "client connected (value: URL)",
+		"disconnected": "client disconnected (value: error)",
+		"subscribed":   "server client subscribed (value: remote, query)",
+		"denied":       "server client denied (value: remote, reason)",
+	}
+
 	s.eio = extio.NewExtio(parent, 0)
 	return s
 }
@@ -66,6 +127,31 @@ func (s *Websocket) Attach() error {
 	} else {
 		s.timeout = 10 * time.Second
 	}
+	s.retry = k.Bool("retry")
+	s.retryMax = k.Duration("retry-max")
+	if s.retry && s.retryMax < time.Second {
+		return fmt.Errorf("--retry-max: must be at least 1s")
+	}
+	s.keepalive = k.Duration("keepalive")
+	s.idle = k.Duration("idle-timeout")
+	s.resume = k.Bool("resume")
+	if s.resume && k.Bool("pcap") {
+		return fmt.Errorf("--resume: not supported with --pcap")
+	}
+	if k.Bool("compress") {
+		s.compress = k.Int("compress-level")
+		if s.compress < 1 || s.compress > 9 {
+			return fmt.Errorf("--compress-level: must be 1-9")
+		}
+	}
+	s.batch = k.Int("batch")
+	s.batchWait = k.Duration("batch-delay")
+	if s.batch < 0 || s.batchWait < 0 {
+		return fmt.Errorf("--batch and --batch-delay: must not be negative")
+	} else if s.batch > 0 && k.Bool("pcap") {
+		return fmt.Errorf("--batch: not supported with --pcap")
+	}
+	s.binary = k.Bool("raw") || k.Bool("mrt") || k.Bool("pcap") || k.Bool("proto")
 
 	// check URL
 	url, err := url.Parse(k.String("url"))
@@ -89,26 +175,9 @@ func (s *Websocket) Attach() error {
 	}
 	s.url = *url
 
-	// SSL config
-	if s.url.Scheme == "wss" {
-		s.tls = &tls.Config{}
-
-		// skip SSL cert verify?
-		if k.Bool("insecure") {
-			s.tls.InsecureSkipVerify = true
-		}
-
-		// load certificate and key
-		has_certkey := k.String("cert") != "" && k.String("key") != ""
-		if has_certkey {
-			cert, err := tls.LoadX509KeyPair(k.String("cert"), k.String("key"))
-			if err != nil {
-				return fmt.Errorf("--cert and --key: %w", err)
-			}
-			s.tls.Certificates = append(s.tls.Certificates, cert)
-		} else if k.Bool("listen") {
-			return fmt.Errorf("wss:// server requires --cert and --key")
-		}
+	// SSL config and auth
+	if err := s.auth.attach(s.url.Scheme == "wss", k.Bool("listen")); err != nil {
+		return err
 	}
 
 	// HTTP headers
@@ -122,36 +191,16 @@ func (s *Websocket) Attach() error {
 		s.headers.Set(key, val)
 	}
 
-	// HTTP auth
-	if v := k.String("auth"); len(v) > 0 {
-		// read credentials from env or file
-		var cred []byte
-		if v[0] == '$' && len(v) >= 2 {
-			cred = []byte(os.Getenv(v[1:]))
-		} else {
-			fh, err := os.Open(v)
-			if err != nil {
-				return fmt.Errorf("--auth: %w", err)
-			}
-			cred = make([]byte, 128)
-			n, err := fh.Read(cred)
-			if err != nil {
-				return fmt.Errorf("--auth: file %s: %w", v, err)
-			}
-			cred, _, _ = bytes.Cut(cred[:n], []byte{'\n'})
-		}
-
-		// sanity check
-		if bytes.IndexByte(cred, ':') < 0 {
-			return fmt.Errorf("--auth: invalid format, need user:pass")
-		}
-
-		// add HTTP header
-		auth := "Basic " + base64.StdEncoding.EncodeToString(cred)
-		s.headers.Set("Authorization", auth)
+	// route output to the server conns
+	if k.Bool("listen") {
+		s.resumeRcv = make(map[string]*atomic.Int64)
+		s.fan.attach(s.eio)
+	} else if s.resume {
+		var id [16]byte
+		rand.Read(id[:])
+		s.resumeID = hex.EncodeToString(id[:])
 	}
 
-	s.serverConn = make(chan *websocket.Conn, 10)
 	return s.eio.Attach()
 }
 
@@ -164,27 +213,63 @@ func (s *Websocket) Prepare() error {
 }
 
 func (s *Websocket) prepareClient() error {
+	conn, err := s.dial()
+	if err != nil {
+		if !s.retry {
+			return err
+		}
+		s.Warn().Err(err).Msg("could not connect, will retry")
+		return nil
+	}
+
+	// success
+	s.clientConn = conn
+	return nil
+}
+
+// dial connects to the websocket server
+func (s *Websocket) dial() (*websocket.Conn, error) {
 	// websocket dialer
 	dialer := websocket.Dialer{
-		Proxy:            http.ProxyFromEnvironment,
-		HandshakeTimeout: s.timeout,
-		TLSClientConfig:  s.tls,
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  s.timeout,
+		TLSClientConfig:   s.auth.clientTLS(),
+		EnableCompression: s.compress > 0,
+	}
+
+	// auth and resume headers
+	headers := s.headers.Clone()
+	s.auth.clientAuth(headers)
+	if s.resume {
+		headers.Set(wsStreamHeader, s.resumeID)
 	}
 
 	// dial
 	url := s.url.String()
 	s.Info().Msgf("dialing %s", url)
-	conn, resp, err := dialer.DialContext(s.Ctx, url, s.headers)
+	conn, resp, err := dialer.DialContext(s.Ctx, url, headers)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	s.Info().
 		Interface("headers", resp.Header).
 		Msgf("connected %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
+	s.connSetup(conn)
+	s.Event("connected", url)
+
+	// how many frames did the server get?
+	s.resumeAck = -1
+	if v := resp.Header.Get(wsResumeHeader); s.resume && v != "" {
+		s.resumeAck, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || s.resumeAck < 0 || s.resumeAck > s.sentN {
+			s.Warn().Msgf("invalid %s header: %s", wsResumeHeader, v)
+			s.resumeAck = -1
+		}
+	} else if s.resume {
+		s.Warn().Msg("--resume: not supported by the server")
+	}
 
-	// success
-	s.clientConn = conn
-	return nil
+	return conn, nil
 }
 
 func (s *Websocket) prepareServer() error {
@@ -198,7 +283,7 @@ func (s *Websocket) prepareServer() error {
 		Handler:     mux,
 		Addr:        s.url.Host,
 		BaseContext: func(l net.Listener) context.Context { return s.Ctx },
-		TLSConfig:   s.tls,
+		TLSConfig:   s.auth.tls,
 	}
 
 	// ok go!
@@ -224,51 +309,85 @@ func (s *Websocket) serverListen() {
 func (s *Websocket) serverHandle(w http.ResponseWriter, r *http.Request) {
 	headers := s.headers
 
-	// require authorization?
-	if auth := headers.Get("Authorization"); len(auth) > 0 {
-		if r.Header.Get("Authorization") != auth {
-			w.Header().Set("WWW-Authenticate", `Basic realm="bgpipe"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+	// client allowed?
+	if !s.auth.serverCheck(w, r) {
+		return
+	}
 
-		// avoid sending auth back to client
-		headers = headers.Clone()
-		headers.Del("Authorization")
+	// client subscription and role
+	q := r.URL.Query()
+	sub, err := extio.ParseFilter(q)
+	if err != nil {
+		http.Error(w, "Invalid subscription: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	write := true
+	switch v := q.Get("role"); v {
+	case "", "rw":
+		break // default
+	case "read":
+		write = false
+	default:
+		http.Error(w, "Invalid role: "+v, http.StatusBadRequest)
+		return
 	}
 
 	// websocket upgrader
 	upgrader := &websocket.Upgrader{
-		HandshakeTimeout: s.timeout,
+		HandshakeTimeout:  s.timeout,
+		EnableCompression: s.compress > 0,
+	}
+	rcvd := s.serverStream(r.Header.Get(wsStreamHeader))
+	if rcvd != nil {
+		headers = headers.Clone()
+		headers.Set(wsResumeHeader, strconv.FormatInt(rcvd.Load(), 10))
 	}
 	conn, err := upgrader.Upgrade(w, r, headers)
 	if err != nil {
 		s.Warn().Err(err).Msgf("%s: could not upgrade", r.RemoteAddr)
 		return
 	}
-
-	// publish conn for broadcasts + signal to connWriter
-	if !send_safe(s.serverConn, conn) || !send_safe(s.eio.Output, nil) {
-		s.Warn().Msgf("%s: could not register new connection", r.RemoteAddr)
-		return
+	s.connSetup(conn)
+
+	// register the client
+	c := &wsClient{
+		conn:   conn,
+		remote: conn.RemoteAddr().String(),
+		write:  write,
+		rcvd:   rcvd,
+	}
+	c.sub.Store(sub)
+	c.fanClient = s.fan.add(func(m *msg.Msg) bool {
+		return c.sub.Load().Match(m)
+	})
+	s.Info().Bool("write", write).Msgf("%s: new client", c.remote)
+	if sub != nil {
+		s.Event("subscribed", c.remote, r.URL.RawQuery)
 	}
 
 	// block on conn reader
-	err = s.connReader(conn, nil)
-	s.Info().Err(err).Msgf("%s: reader finished", r.RemoteAddr)
-
-	// close
+	stop := make(chan struct{})
+	go s.connPinger(conn, stop)
+	go s.connWriter(c)
+	err = s.connReader(conn, c, nil)
+	close(stop)
+	s.Info().Err(err).Msgf("%s: reader finished", c.remote)
+
+	// unregister and close
+	s.fan.remove(c.fanClient)
 	err = conn.Close()
 	if err != nil {
-		s.Warn().Err(err).Msgf("%s: close error", r.RemoteAddr)
+		s.Debug().Err(err).Msgf("%s: close error", c.remote)
 	}
 }
 
 func (s *Websocket) Stop() error {
-	close_safe(s.eio.Output)
+	s.stopping.Store(true)
+	s.clientMu.Lock()
 	if s.clientConn != nil {
 		s.clientConn.Close()
 	}
+	s.clientMu.Unlock()
 	if s.srv != nil {
 		s.srv.Close()
 	}
@@ -278,40 +397,254 @@ func (s *Websocket) Stop() error {
 }
 
 func (s *Websocket) Run() (err error) {
-	// conn writer
-	conn_writer_done := make(chan error, 1)
-	go s.connWriter(conn_writer_done)
+	if !s.K.Bool("listen") {
+		return s.runClient()
+	}
 
-	// client conn reader if needed
-	conn_reader_done := make(chan error, 1)
-	if s.clientConn != nil {
-		go s.connReader(s.clientConn, conn_reader_done)
+	// wait for signals, closing all server conns on exit
+	if err := s.fan.run(s.Ctx); err != nil {
+		s.Debug().Err(err).Msg("context cancel")
+		return err
+	}
+	s.Debug().Msg("output closed")
+	return fmt.Errorf("writer closed: %w", io.EOF)
+}
+
+// runClient runs the client data flow, reconnecting if needed
+func (s *Websocket) runClient() error {
+	delay := time.Second
+	for {
+		s.clientMu.Lock()
+		conn := s.clientConn
+		s.clientMu.Unlock()
+
+		// run the connection
+		if conn != nil {
+			started := time.Now()
+			err := s.clientRun(conn)
+			conn.Close()
+			s.Event("disconnected", err)
+
+			switch {
+			case s.stopping.Load() || s.Ctx.Err() != nil:
+				return err
+			case !s.retry:
+				return err
+			}
+
+			// connection was fine for a while?
+			if time.Since(started) > s.retryMax {
+				delay = time.Second
+			}
+		}
+
+		// back off
+		s.Warn().Msgf("reconnecting in %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-s.Ctx.Done():
+			return context.Cause(s.Ctx)
+		}
+		delay = min(delay*2, s.retryMax)
+
+		// re-dial
+		conn, err := s.dial()
+		if err != nil {
+			s.Warn().Err(err).Msg("could not connect")
+			conn = nil
+		}
+		s.clientMu.Lock()
+		s.clientConn = conn
+		s.clientMu.Unlock()
+	}
+}
+
+// clientRun runs the data flow for given client connection
+func (s *Websocket) clientRun(conn *websocket.Conn) error {
+	reader_done := make(chan error, 1)
+	go s.connReader(conn, nil, reader_done)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.connPinger(conn, stop)
+
+	// re-send the frames that the server missed?
+	if err := s.clientResume(conn); err != nil {
+		return fmt.Errorf("writer closed: %w", err)
+	}
+
+	// re-send the message that failed before?
+	if bb := s.pending; bb != nil {
+		if err := conn.WriteMessage(websocket.BinaryMessage, s.trim(bb.B)); err != nil {
+			return fmt.Errorf("writer closed: %w", err)
+		}
+		s.clientSent(bb.B)
+		s.pending = nil
+		s.eio.Put(bb)
 	}
 
-	// wait for signals
 	for {
 		select {
-		case err := <-conn_reader_done:
+		case err := <-reader_done:
 			s.Debug().Err(err).Msg("reader done")
 			if err == nil {
 				err = io.EOF
 			}
 			return fmt.Errorf("reader closed: %w", err)
-		case err := <-conn_writer_done:
-			s.Debug().Err(err).Msg("writer done")
-			if err == nil {
-				err = io.EOF
+		case bb, ok := <-s.eio.Output:
+			if !ok {
+				return fmt.Errorf("writer closed: %w", io.EOF)
+			} else if bb == nil {
+				continue
 			}
-			return fmt.Errorf("writer closed: %w", err)
+			s.connBatch(bb, s.eio.Output)
+			if err := conn.WriteMessage(websocket.BinaryMessage, s.trim(bb.B)); err != nil {
+				if s.resume { // the server will tell if it got bb
+					s.clientSent(bb.B)
+					s.eio.Put(bb)
+				} else {
+					s.pending = bb // try again after reconnect
+				}
+				return fmt.Errorf("writer closed: %w", err)
+			}
+			s.clientSent(bb.B)
+			s.eio.Put(bb)
 		case <-s.Ctx.Done():
-			err := context.Cause(s.Ctx)
-			s.Debug().Err(err).Msg("context cancel")
+			return context.Cause(s.Ctx)
+		}
+	}
+}
+
+// clientSent records a frame sent by the client, for --resume
+func (s *Websocket) clientSent(buf []byte) {
+	s.sentN++
+	if !s.resume {
+		return
+	}
+
+	// keep at most as many frames as the output queue
+	if len(s.sent) >= cap(s.eio.Output) {
+		s.sent = s.sent[1:]
+	}
+	s.sent = append(s.sent, wsFrame{n: s.sentN, buf: bytes.Clone(buf)})
+}
+
+// clientResume re-sends the frames that the server did not get, for --resume
+func (s *Websocket) clientResume(conn *websocket.Conn) error {
+	ack := s.resumeAck
+	if ack < 0 || ack >= s.sentN {
+		return nil
+	}
+
+	// gap?
+	if len(s.sent) == 0 || s.sent[0].n > ack+1 {
+		lost := s.sentN - ack - int64(len(s.sent))
+		s.Warn().Msgf("--resume: %d frames lost, not kept for re-sending", lost)
+	}
+
+	var n int
+	for _, f := range s.sent {
+		if f.n <= ack {
+			continue
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, s.trim(f.buf)); err != nil {
 			return err
 		}
+		n++
+	}
+	s.Info().Msgf("--resume: re-sent %d frames", n)
+	return nil
+}
+
+// serverStream returns the received frame counter for given client stream ID,
+// or nil if --resume is not set or id is invalid
+func (s *Websocket) serverStream(id string) *atomic.Int64 {
+	if !s.resume || len(id) == 0 || len(id) > 64 {
+		return nil
+	}
+
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+	rcvd := s.resumeRcv[id]
+	if rcvd == nil {
+		if len(s.resumeRcv) >= 1024 {
+			for k := range s.resumeRcv { // forget a random stream
+				delete(s.resumeRcv, k)
+				break
+			}
+		}
+		rcvd = new(atomic.Int64)
+		s.resumeRcv[id] = rcvd
+	}
+	return rcvd
+}
+
+// connSetup configures new conn
+func (s *Websocket) connSetup(conn *websocket.Conn) {
+	if s.compress > 0 {
+		conn.SetCompressionLevel(s.compress)
+	}
+}
+
+// connBatch appends to bb more messages read from ch, if --batch is set,
+// until bb has at least s.batch bytes or s.batchWait time passes
+func (s *Websocket) connBatch(bb *bytebufferpool.ByteBuffer, ch chan *bytebufferpool.ByteBuffer) {
+	if s.batch <= 0 || len(bb.B) >= s.batch {
+		return
+	}
+
+	timer := time.NewTimer(s.batchWait)
+	defer timer.Stop()
+
+	for len(bb.B) < s.batch {
+		select {
+		case next, ok := <-ch:
+			if !ok {
+				return
+			} else if next != nil {
+				bb.B = append(bb.B, next.B...)
+				s.eio.Put(next)
+			}
+		case <-timer.C:
+			return
+		case <-s.Ctx.Done():
+			return
+		}
+	}
+}
+
+// trim returns buf without the trailing newline of text formats
+func (s *Websocket) trim(buf []byte) []byte {
+	if s.binary {
+		return buf
+	}
+	return bytes.TrimSpace(buf)
+}
+
+// connPinger sends pings to conn every s.keepalive, until stop is closed
+func (s *Websocket) connPinger(conn *websocket.Conn, stop chan struct{}) {
+	if s.keepalive <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.timeout))
+			if err != nil {
+				s.Debug().Err(err).Msgf("%s: ping error", conn.RemoteAddr())
+				return
+			}
+		}
 	}
 }
 
-func (s *Websocket) connReader(conn *websocket.Conn, done chan error) error {
+// connReader reads messages from conn; c is non-nil for server conns
+func (s *Websocket) connReader(conn *websocket.Conn, c *wsClient, done chan error) error {
 	defer func() {
 		conn.Close()
 		close_safe(done)
@@ -325,6 +658,16 @@ func (s *Websocket) connReader(conn *websocket.Conn, done chan error) error {
 		return true
 	}
 
+	// close idle connections
+	extend := func(string) error { return nil }
+	if s.idle > 0 {
+		extend = func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(s.idle))
+		}
+		extend("")
+		conn.SetPongHandler(extend)
+	}
+
 	// read messages from conn
 	for {
 		mt, buf, err := conn.ReadMessage()
@@ -332,18 +675,36 @@ func (s *Websocket) connReader(conn *websocket.Conn, done chan error) error {
 			send_safe(done, err)
 			return err
 		}
+		extend("")
 
 		switch mt {
 		case websocket.BinaryMessage:
 			// ok
 		case websocket.TextMessage:
-			// ok
+			// a server control frame?
+			if c != nil && isControl(buf) {
+				if err := s.serverControl(c, buf); err != nil {
+					send_safe(done, err)
+					return err
+				}
+				continue
+			}
 		default:
 			s.Warn().Msgf("%s: read invalid message type: %d", conn.RemoteAddr(), mt)
 			continue
 		}
 
-		err = s.eio.ReadSingle(buf, cb)
+		// count --resume frames
+		if c != nil && c.rcvd != nil {
+			c.rcvd.Add(1)
+		}
+
+		// read-only client?
+		if c != nil && !c.write {
+			continue
+		}
+
+		err = s.eio.ReadBatchFrom(remote, buf, cb)
 		if err != nil {
 			send_safe(done, err)
 			return err
@@ -351,51 +712,49 @@ func (s *Websocket) connReader(conn *websocket.Conn, done chan error) error {
 	}
 }
 
-func (s *Websocket) connWriter(done chan error) {
-	defer func() {
-		close_safe(s.serverConn)
-		close_safe(s.eio.Output)
-		close_safe(done)
-	}()
+// isControl returns true iff buf looks like a server control frame
+func isControl(buf []byte) bool {
+	buf = bytes.TrimSpace(buf)
+	return len(buf) > 0 && buf[0] == '{' && bytes.Contains(buf, []byte(`"subscribe"`))
+}
 
-	// a map of connections, the value is true iff the connection is critical
-	conns := make(map[*websocket.Conn]bool)
-	if s.clientConn != nil {
-		conns[s.clientConn] = true
+// serverControl handles a control frame from server conn c, eg. {"subscribe":"dir=L&type=UPDATE"}
+func (s *Websocket) serverControl(c *wsClient, buf []byte) error {
+	var ctrl struct {
+		Subscribe string `json:"subscribe"`
 	}
-	for len(s.serverConn) > 0 {
-		conns[<-s.serverConn] = false
+	if err := json.Unmarshal(buf, &ctrl); err != nil {
+		return fmt.Errorf("invalid control frame: %w", err)
 	}
 
-	for bb := range s.eio.Output {
-		// signal to reload the server conns?
-		if bb == nil {
-			for len(s.serverConn) > 0 {
-				conns[<-s.serverConn] = false
-			}
-			continue
-		}
+	q, err := url.ParseQuery(ctrl.Subscribe)
+	if err != nil {
+		return fmt.Errorf("invalid subscription: %w", err)
+	}
+	sub, err := extio.ParseFilter(q)
+	if err != nil {
+		return fmt.Errorf("invalid subscription: %w", err)
+	}
 
-		// broadcast buf to all conns
-		buf := bytes.TrimSpace(bb.B)
-		for conn, critical := range conns {
-			if conn == nil {
-				continue
-			}
-			err := conn.WriteMessage(websocket.BinaryMessage, buf)
-			if err != nil {
-				if critical {
-					send_safe(done, err)
-					return
-				} else {
-					s.Warn().Err(err).Msgf("%s: write error", conn.RemoteAddr())
-					conn.Close()
-					delete(conns, conn)
-				}
-			}
-		}
+	c.sub.Store(sub)
+	s.Event("subscribed", c.remote, ctrl.Subscribe)
+	return nil
+}
+
+// connWriter writes the output queue of server conn c
+func (s *Websocket) connWriter(c *wsClient) {
+	defer s.fan.remove(c.fanClient)
 
-		// re-use bb
+	for bb := range c.out {
+		s.connBatch(bb, c.out)
+		err := c.conn.WriteMessage(websocket.BinaryMessage, s.trim(bb.B))
 		s.eio.Put(bb)
+		if err != nil {
+			s.Warn().Err(err).Msgf("%s: write error", c.remote)
+			break
+		}
 	}
+
+	// output closed or write error: close the conn, which will stop connReader
+	c.conn.Close()
 }
@@ -25,7 +25,8 @@ type Write struct {
 	opt_compress string
 
 	fh      *os.File
-	wr      io.WriteCloser
+	wr      io.WriteCloser // fh, or a compressor writing to fh
+	ew      io.WriteCloser // extio format writer to wr
 	timeout time.Time
 }
 
@@ -58,6 +59,9 @@ func (s *Write) Attach() error {
 	s.flags = os.O_CREATE | os.O_WRONLY
 
 	if k.Bool("append") {
+		if k.Bool("parquet") {
+			return fmt.Errorf("--append: not supported with --parquet")
+		}
 		s.flags |= os.O_APPEND
 	} else if k.Bool("create") {
 		s.flags |= os.O_EXCL
@@ -103,11 +107,12 @@ func (s *Write) reopenFile(now time.Time) error {
 		}
 
 		// close the current file in background
-		go func(wr io.WriteCloser, fh *os.File) {
+		go func(ew, wr io.WriteCloser, fh *os.File) {
 			s.Debug().Msgf("closing %s", fh.Name())
+			ew.Close()
 			wr.Close()
 			fh.Close()
-		}(s.wr, s.fh)
+		}(s.ew, s.wr, s.fh)
 	}
 
 	// replace $TIME in target
@@ -136,12 +141,19 @@ func (s *Write) reopenFile(now time.Time) error {
 		s.wr = gzip.NewWriter(fh)
 	}
 
-	return nil
+	// needs a file header? (skip if appending)
+	header := true
+	if fi, err := fh.Stat(); err == nil && fi.Size() > 0 {
+		header = false
+	}
+	s.ew, err = s.eio.NewWriter(s.wr, header)
+	return err
 }
 
 func (s *Write) Run() (err error) {
 	defer func() {
 		s.Debug().Msgf("closing %s", s.fh.Name())
+		s.ew.Close()
 		s.wr.Close()
 		s.fh.Close()
 	}()
@@ -159,7 +171,7 @@ func (s *Write) Run() (err error) {
 		}
 
 		// write to file
-		_, err = bb.WriteTo(s.wr)
+		_, err = bb.WriteTo(s.ew)
 		if err != nil {
 			break
 		}